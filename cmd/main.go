@@ -1,16 +1,23 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/zhengtianbao/promproxy/config"
 	"github.com/zhengtianbao/promproxy/middleware"
 	"github.com/zhengtianbao/promproxy/server"
-	"gopkg.in/natefinch/lumberjack.v2"
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
 	os.Exit(run())
 }
 
@@ -20,31 +27,101 @@ func run() int {
 		configFile = os.Args[1]
 	}
 
-	log.SetOutput(&lumberjack.Logger{
-    Filename:   "promproxy.log",
-    MaxSize:    100,
-    MaxBackups: 3,
-    MaxAge:     28,
-    Compress:   true,
-})
+	cfg, err := config.LoadFile(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config %s: %v\n", configFile, err)
+		return 1
+	}
+
+	logger, logFile, err := server.NewLogger(cfg.Logging)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error creating logger: %v\n", err)
+		return 1
+	}
+	defer logFile.Close()
+	slog.SetDefault(logger)
+	slog.Info("Loaded configuration", "file", configFile)
 
-	log.Printf("config: %s", configFile)
-	config, err := config.LoadFile(configFile)
+	proxy, err := server.NewProxyServer(cfg)
 	if err != nil {
-		log.Printf("err: %s", err)
-		os.Exit(1)
+		slog.Error("Error creating proxy server", "err", err)
+		return 1
 	}
 
-	server := server.NewProxyServer(config)
-	middlewares := []middleware.Middleware{
-		middleware.NewLabelValidateMiddleware(config.Rules.AllowedSpaces),
-		middleware.NewTimeValidateMiddleware(),
-		middleware.NewFunctionValidateMiddleware(),
-		middleware.NewQueryRangeMiddleware(),
+	seriesCounter := proxy.SeriesCounter()
+	build := func(cfg *config.Config) (*server.Pipeline, error) {
+		return newPipeline(cfg, seriesCounter)
+	}
+	pipeline, err := build(cfg)
+	if err != nil {
+		slog.Error("Error creating middleware pipeline", "err", err)
+		return 1
 	}
-	server.RegisterMiddlewares(middlewares...)
-	if err := server.Start(); err != nil {
-		log.Printf("err: %s", err)
+	proxy.SetPipeline(pipeline)
+	if err := proxy.EnableReload(configFile, build); err != nil {
+		slog.Error("Error enabling configuration reload", "err", err)
+		return 1
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			proxy.Reload()
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := proxy.Start(ctx); err != nil {
+		slog.Error("Proxy server stopped", "err", err)
+		return 1
 	}
 	return 0
 }
+
+// newPipeline 按配置创建 PromQL 解析器和校验中间件，启动和热加载时使用
+func newPipeline(cfg *config.Config, seriesCounter middleware.SeriesCounter) (*server.Pipeline, error) {
+	queryParser, err := middleware.NewQueryParser(middleware.ParserOptions{
+		ExperimentalFunctions: cfg.Parser.EnableExperimentalFunctions,
+		DurationExpressions:   cfg.Parser.EnableDurationExpressions,
+		EnabledFunctions:      cfg.Parser.EnabledFunctions,
+		DisabledFunctions:     cfg.Parser.DisabledFunctions,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	pipeline := &server.Pipeline{
+		Config:      cfg,
+		QueryParser: queryParser,
+		Middlewares: []middleware.Middleware{
+			middleware.NewLabelValidateMiddleware(cfg.Rules.AllowedSpaces),
+			middleware.NewTimeValidateMiddleware(),
+			middleware.NewFunctionValidateMiddleware(),
+			middleware.NewQueryRangeMiddleware(),
+		},
+	}
+	if cfg.Rules.Cardinality.Enabled || cfg.Rules.Cost.Enabled {
+		ttl := cfg.Rules.Cardinality.CacheTTL
+		if ttl <= 0 {
+			ttl = time.Minute
+		}
+		counter := middleware.NewCachedSeriesCounter(seriesCounter, ttl)
+
+		if cfg.Rules.Cardinality.Enabled {
+			pipeline.Middlewares = append(pipeline.Middlewares, middleware.NewCardinalityMiddleware(counter, func(tenant string) int {
+				return cfg.LimitsFor(tenant).MaxSeries
+			}, cfg.Rules.Cardinality.Lookback))
+		}
+		if cfg.Rules.Cost.Enabled {
+			estimator := middleware.NewCostEstimator(counter, cfg.Rules.Cost.ScrapeInterval, cfg.Rules.Cardinality.Lookback)
+			pipeline.Middlewares = append(pipeline.Middlewares, middleware.NewCostMiddleware(estimator, func(tenant string) int64 {
+				return cfg.LimitsFor(tenant).MaxSamples
+			}))
+			pipeline.CostEstimator = estimator
+		}
+	}
+
+	return pipeline, nil
+}
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/zhengtianbao/promproxy/config"
+	"github.com/zhengtianbao/promproxy/middleware"
+	"github.com/zhengtianbao/promproxy/server"
+)
+
+const replayUsage = `Usage: promproxy replay [flags] LOG_FILE...
+
+Replays the queries recorded in JSONL audit or access logs through the
+middleware chain of a configuration without contacting any backend, and
+reports the rejected queries grouped by rule, tenant and query fingerprint.
+With -compare, only the queries whose result differs between the two
+configurations are reported. Use - to read from standard input.
+
+Flags:
+`
+
+// replayEntry 为审计日志或 JSON 格式访问日志中的一条记录
+type replayEntry struct {
+	Time     time.Time `json:"time"`
+	Msg      string    `json:"msg"`
+	Path     string    `json:"path"`
+	Tenant   string    `json:"tenant"`
+	Query    string    `json:"query"`
+	Start    string    `json:"start"`
+	End      string    `json:"end"`
+	EvalTime string    `json:"eval_time"`
+	Step     string    `json:"step"`
+}
+
+// replayResult 为一条记录在某个配置下的校验结果
+type replayResult struct {
+	// rules 为违反的规则，格式为 middleware/rule，已排序
+	rules       []string
+	fingerprint string
+}
+
+// runReplay 实现 replay 子命令
+func runReplay(args []string) int {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	configFile := flags.String("config", "config.yaml", "configuration to replay the queries against")
+	compareFile := flags.String("compare", "", "second configuration; only report queries whose result differs")
+	top := flags.Int("top", 20, "number of query fingerprints to list in each report")
+	flags.Usage = func() {
+		fmt.Fprint(flags.Output(), replayUsage)
+		flags.PrintDefaults()
+	}
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	base, err := replayPipeline(*configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config %s: %v\n", *configFile, err)
+		return 1
+	}
+	var compare *server.Pipeline
+	if *compareFile != "" {
+		if compare, err = replayPipeline(*compareFile); err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading config %s: %v\n", *compareFile, err)
+			return 1
+		}
+	}
+
+	entries, skipped, err := readReplayEntries(flags.Args())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading logs: %v\n", err)
+		return 1
+	}
+	fmt.Printf("Replayed %d queries (%d log records without a query skipped)\n", len(entries), skipped)
+
+	if compare == nil {
+		rejected := newReplayReport(fmt.Sprintf("Rejected by %s", *configFile))
+		for _, entry := range entries {
+			result := replay(base, entry)
+			rejected.add(entry, result.fingerprint, result.rules)
+		}
+		rejected.print(os.Stdout, *top)
+		return 0
+	}
+
+	added := newReplayReport(fmt.Sprintf("Newly rejected by %s", *compareFile))
+	removed := newReplayReport(fmt.Sprintf("No longer rejected by %s", *compareFile))
+	for _, entry := range entries {
+		before, after := replay(base, entry), replay(compare, entry)
+		added.add(entry, after.fingerprint, difference(after.rules, before.rules))
+		removed.add(entry, before.fingerprint, difference(before.rules, after.rules))
+	}
+	added.print(os.Stdout, *top)
+	removed.print(os.Stdout, *top)
+	return 0
+}
+
+// replayPipeline 按配置创建中间件，不创建需要查询后端的基数和成本校验
+func replayPipeline(file string) (*server.Pipeline, error) {
+	cfg, err := config.LoadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	cfg.Rules.Cardinality.Enabled = false
+	cfg.Rules.Cost.Enabled = false
+	return newPipeline(cfg, nil)
+}
+
+// readReplayEntries 读取日志中带有查询的记录，其余的日志记录计入 skipped
+func readReplayEntries(files []string) ([]*replayEntry, int, error) {
+	var entries []*replayEntry
+	skipped := 0
+	for _, file := range files {
+		var in io.Reader = os.Stdin
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return nil, 0, err
+			}
+			defer f.Close()
+			in = f
+		}
+
+		scanner := bufio.NewScanner(in)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for line := 1; scanner.Scan(); line++ {
+			if len(strings.TrimSpace(scanner.Text())) == 0 {
+				continue
+			}
+			entry := &replayEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+				return nil, 0, fmt.Errorf("%s:%d: %v", file, line, err)
+			}
+			// 访问日志中只有 access 记录对应一个请求
+			if entry.Query == "" || (entry.Msg != "" && entry.Msg != "access") {
+				skipped++
+				continue
+			}
+			entries = append(entries, entry)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, 0, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return entries, skipped, nil
+}
+
+// replay 用 pipeline 的中间件校验记录中的查询
+func replay(pl *server.Pipeline, entry *replayEntry) replayResult {
+	params := url.Values{}
+	for key, value := range map[string]string{
+		"query": entry.Query, "start": entry.Start, "end": entry.End, "time": entry.EvalTime, "step": entry.Step,
+	} {
+		if value != "" {
+			params.Set(key, value)
+		}
+	}
+
+	path := entry.Path
+	if path == "" {
+		path = "/api/v1/query"
+		if entry.Step != "" {
+			path = "/api/v1/query_range"
+		}
+	}
+	r := &http.Request{Method: http.MethodGet, URL: &url.URL{Path: path, RawQuery: params.Encode()}, Header: http.Header{}}
+
+	ctx, err := pl.NewRequestContext(r, entry.Tenant, params)
+	if err != nil {
+		return replayResult{rules: []string{"parser/parse_error"}, fingerprint: fingerprint(entry.Query, nil)}
+	}
+	ctx.Now = entry.Time
+
+	result := replayResult{}
+	err = middleware.Process(pl.Middlewares, ctx)
+	var violations middleware.Violations
+	switch {
+	case errors.As(err, &violations):
+		for _, v := range violations {
+			result.rules = append(result.rules, v.Middleware+"/"+v.Rule)
+		}
+		slices.Sort(result.rules)
+		result.rules = slices.Compact(result.rules)
+	case err != nil:
+		result.rules = []string{"error"}
+	}
+	if len(result.rules) > 0 {
+		result.fingerprint = fingerprint(entry.Query, ctx.ParsedAST)
+	}
+	return result
+}
+
+// fingerprint 把查询中的标签取值替换为 ? 后计算哈希，同一面板使用不同变量取值的查询得到相同的指纹
+func fingerprint(query string, expr parser.Expr) string {
+	shape := query
+	if expr != nil {
+		parser.Inspect(expr, func(node parser.Node, _ []parser.Node) error {
+			if vs, ok := node.(*parser.VectorSelector); ok {
+				for _, m := range vs.LabelMatchers {
+					if m.Name != "__name__" {
+						m.Value = "?"
+					}
+				}
+			}
+			return nil
+		})
+		shape = expr.String()
+	}
+
+	h := fnv.New64a()
+	h.Write([]byte(shape))
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// difference 返回在 a 中但不在 b 中的规则
+func difference(a, b []string) []string {
+	var out []string
+	for _, rule := range a {
+		if !slices.Contains(b, rule) {
+			out = append(out, rule)
+		}
+	}
+	return out
+}
+
+type fingerprintStats struct {
+	count   int
+	query   string
+	rules   map[string]bool
+	tenants map[string]bool
+}
+
+// replayReport 按规则、租户和查询指纹统计被拒绝的查询
+type replayReport struct {
+	title        string
+	queries      int
+	rules        map[string]int
+	tenants      map[string]int
+	fingerprints map[string]*fingerprintStats
+}
+
+func newReplayReport(title string) *replayReport {
+	return &replayReport{
+		title:        title,
+		rules:        make(map[string]int),
+		tenants:      make(map[string]int),
+		fingerprints: make(map[string]*fingerprintStats),
+	}
+}
+
+func (r *replayReport) add(entry *replayEntry, fp string, rules []string) {
+	if len(rules) == 0 {
+		return
+	}
+
+	r.queries++
+	for _, rule := range rules {
+		r.rules[rule]++
+	}
+	tenant := entry.Tenant
+	if tenant == "" {
+		tenant = "(none)"
+	}
+	r.tenants[tenant]++
+
+	stats, ok := r.fingerprints[fp]
+	if !ok {
+		stats = &fingerprintStats{query: entry.Query, rules: make(map[string]bool), tenants: make(map[string]bool)}
+		r.fingerprints[fp] = stats
+	}
+	stats.count++
+	for _, rule := range rules {
+		stats.rules[rule] = true
+	}
+	stats.tenants[tenant] = true
+}
+
+func (r *replayReport) print(w io.Writer, top int) {
+	fmt.Fprintf(w, "\n%s: %d queries\n", r.title, r.queries)
+	if r.queries == 0 {
+		return
+	}
+
+	fmt.Fprintf(w, "\nBy rule:\n")
+	for _, rule := range byCount(r.rules) {
+		fmt.Fprintf(w, "  %8d  %s\n", r.rules[rule], rule)
+	}
+
+	fmt.Fprintf(w, "\nBy tenant:\n")
+	for _, tenant := range byCount(r.tenants) {
+		fmt.Fprintf(w, "  %8d  %s\n", r.tenants[tenant], tenant)
+	}
+
+	counts := make(map[string]int, len(r.fingerprints))
+	for fp, stats := range r.fingerprints {
+		counts[fp] = stats.count
+	}
+	fingerprints := byCount(counts)
+	fmt.Fprintf(w, "\nBy query fingerprint (%d distinct):\n", len(fingerprints))
+	for i, fp := range fingerprints {
+		if top > 0 && i >= top {
+			fmt.Fprintf(w, "  ... %d more\n", len(fingerprints)-top)
+			break
+		}
+		stats := r.fingerprints[fp]
+		fmt.Fprintf(w, "  %8d  %s  rules: %s  tenants: %s\n            %s\n",
+			stats.count, fp, strings.Join(sortedSet(stats.rules), ","), strings.Join(sortedSet(stats.tenants), ","), stats.query)
+	}
+}
+
+// byCount 按计数从大到小返回 key，计数相同时按名称排序
+func byCount(counts map[string]int) []string {
+	keys := make([]string, 0, len(counts))
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if counts[keys[i]] != counts[keys[j]] {
+			return counts[keys[i]] > counts[keys[j]]
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+func sortedSet(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
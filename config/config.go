@@ -2,27 +2,319 @@ package config
 
 import (
 	"os"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
 
+// DefaultTenantHeader 为默认的租户请求头。该请求头未经校验，需要由可信的认证代理设置
+const DefaultTenantHeader = "X-Scope-OrgID"
+
+// 默认不向后端转发客户端的凭据
+var DefaultDeniedRequestHeaders = []string{"Authorization", "Cookie"}
+
 type Config struct {
-	Server     ServerConfig     `yaml:"server"`
-	Prometheus PrometheusConfig `yaml:"prometheus"`
-	Rules      RulesConfig      `yaml:"rules"`
+	Server     ServerConfig            `yaml:"server"`
+	Prometheus PrometheusConfig        `yaml:"prometheus"`
+	Rules      RulesConfig             `yaml:"rules"`
+	Parser     ParserConfig            `yaml:"parser"`
+	Cache      ResultsCacheConfig      `yaml:"results_cache"`
+	Splitting  QuerySplittingConfig    `yaml:"query_splitting"`
+	Coalescing CoalescingConfig        `yaml:"coalescing"`
+	RateLimits RateLimitsConfig        `yaml:"rate_limits"`
+	Limits     LimitsConfig            `yaml:"limits"`
+	Tenants    map[string]LimitsConfig `yaml:"tenants"`
+	Logging    LoggingConfig           `yaml:"logging"`
+	Audit      AuditConfig             `yaml:"audit"`
 }
 
 type ServerConfig struct {
 	Port           int `yaml:"port"`
 	MaxConcurrency int `yaml:"max_concurrency"`
+
+	// 代理信任 tenant_header 中的租户，部署时必须由认证代理覆盖客户端传入的值
+	TenantHeader string `yaml:"tenant_header"`
+
+	// admin_port 不为 0 时 /metrics 和 /-/reload 只在该端口提供
+	AdminPort int `yaml:"admin_port"`
+
+	// 每个租户最多排队的请求数，以及请求在队列中的最长等待时间
+	MaxQueueLength int           `yaml:"max_queue_length"`
+	MaxQueueWait   time.Duration `yaml:"max_queue_wait"`
+
+	// 收到退出信号后就绪检查先失败 shutdown_delay，再在 drain_timeout 内等待已接收的请求完成
+	ShutdownDelay time.Duration `yaml:"shutdown_delay"`
+	DrainTimeout  time.Duration `yaml:"drain_timeout"`
+
+	Reload ReloadConfig `yaml:"reload"`
+}
+
+// ReloadConfig 控制配置热加载，watch_interval 为 0 时不检查配置文件变化；
+// /-/reload 接口需要携带 auth_token 作为 Bearer token，未配置 token 时接口不可用
+type ReloadConfig struct {
+	WatchInterval time.Duration `yaml:"watch_interval"`
+	AuthToken     string        `yaml:"auth_token"`
+	AuthTokenFile string        `yaml:"auth_token_file"`
 }
 
 type PrometheusConfig struct {
-	URL string `yaml:"url"`
+	URL           string              `yaml:"url"`
+	Endpoints     []string            `yaml:"endpoints"`
+	Strategy      string              `yaml:"strategy"`
+	HealthCheck   HealthCheckConfig   `yaml:"health_check"`
+	PassiveHealth PassiveHealthConfig `yaml:"passive_health"`
+	Client        ClientConfig        `yaml:"client"`
+	Retry         RetryConfig         `yaml:"retry"`
+	Breaker       BreakerConfig       `yaml:"circuit_breaker"`
+	Forward       ForwardConfig       `yaml:"forward"`
+	Routes        []RouteConfig       `yaml:"routes"`
+	Fanout        FanoutConfig        `yaml:"fanout"`
+}
+
+// FanoutConfig 允许查询跨越不同后端的 space 时并行查询各后端并合并结果，
+// partial_response 为 fail 时任一后端失败即返回错误，为 warn 时返回部分结果并附带 warning
+type FanoutConfig struct {
+	Enabled         bool   `yaml:"enabled"`
+	PartialResponse string `yaml:"partial_response"`
+}
+
+// RouteConfig 把指定 space 的请求路由到单独的后端，健康检查配置沿用全局设置
+type RouteConfig struct {
+	Spaces    []string `yaml:"spaces"`
+	Endpoints []string `yaml:"endpoints"`
+	Strategy  string   `yaml:"strategy"`
+}
+
+// BackendURLs 返回所有后端地址，未配置 endpoints 时使用 url
+func (p PrometheusConfig) BackendURLs() []string {
+	if len(p.Endpoints) > 0 {
+		return p.Endpoints
+	}
+	if p.URL != "" {
+		return []string{p.URL}
+	}
+	return nil
+}
+
+// HealthCheckConfig 为主动健康检查配置，interval 为 0 时不做主动检查
+type HealthCheckConfig struct {
+	Path     string        `yaml:"path"`
+	Interval time.Duration `yaml:"interval"`
+	Timeout  time.Duration `yaml:"timeout"`
+}
+
+// PassiveHealthConfig 为被动摘除配置，连续失败 max_failures 次后摘除 ejection_time
+type PassiveHealthConfig struct {
+	MaxFailures  int           `yaml:"max_failures"`
+	EjectionTime time.Duration `yaml:"ejection_time"`
+}
+
+// ClientConfig 为访问后端的 HTTP 客户端配置，所有后端共用，*_file 中的凭据在文件变化后自动重新读取
+type ClientConfig struct {
+	TLS             TLSConfig         `yaml:"tls"`
+	BasicAuth       *BasicAuthConfig  `yaml:"basic_auth"`
+	BearerToken     string            `yaml:"bearer_token"`
+	BearerTokenFile string            `yaml:"bearer_token_file"`
+	Headers         map[string]string `yaml:"headers"`
+
+	DialTimeout           time.Duration `yaml:"dial_timeout"`
+	TLSHandshakeTimeout   time.Duration `yaml:"tls_handshake_timeout"`
+	ResponseHeaderTimeout time.Duration `yaml:"response_header_timeout"`
+	IdleConnTimeout       time.Duration `yaml:"idle_conn_timeout"`
+	MaxIdleConns          int           `yaml:"max_idle_conns"`
+	MaxIdleConnsPerHost   int           `yaml:"max_idle_conns_per_host"`
+	MaxConnsPerHost       int           `yaml:"max_conns_per_host"`
+}
+
+// TLSConfig 中 cert_file 与 key_file 为客户端证书，文件变化后在下次握手时重新加载
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+type BasicAuthConfig struct {
+	Username     string `yaml:"username"`
+	Password     string `yaml:"password"`
+	PasswordFile string `yaml:"password_file"`
+}
+
+// RetryConfig 控制幂等请求在连接错误和 502/503/504 时的重试，max_attempts 包含首次请求，
+// 两次尝试之间按 initial_backoff 起始、不超过 max_backoff 的抖动指数退避等待
+type RetryConfig struct {
+	MaxAttempts    int           `yaml:"max_attempts"`
+	InitialBackoff time.Duration `yaml:"initial_backoff"`
+	MaxBackoff     time.Duration `yaml:"max_backoff"`
+}
+
+// BreakerConfig 为每个后端的熔断配置，连续失败 failure_threshold 次后熔断 open_duration，
+// 之后进入半开状态放行 half_open_requests 个探测请求，全部成功后恢复
+type BreakerConfig struct {
+	Enabled          bool          `yaml:"enabled"`
+	FailureThreshold int           `yaml:"failure_threshold"`
+	OpenDuration     time.Duration `yaml:"open_duration"`
+	HalfOpenRequests int           `yaml:"half_open_requests"`
+}
+
+// ForwardConfig 控制请求转发，flush_interval 为负数时每次写入后立即 flush
+type ForwardConfig struct {
+	FlushInterval   time.Duration `yaml:"flush_interval"`
+	RequestHeaders  HeaderFilter  `yaml:"request_headers"`
+	ResponseHeaders HeaderFilter  `yaml:"response_headers"`
+}
+
+// HeaderFilter 中 allow 非空时只转发列出的 header，deny 中的 header 总是被移除
+type HeaderFilter struct {
+	Allow []string `yaml:"allow"`
+	Deny  []string `yaml:"deny"`
 }
 
 type RulesConfig struct {
-	AllowedSpaces []string `yaml:"allowed_spaces"`
+	AllowedSpaces []string          `yaml:"allowed_spaces"`
+	Cardinality   CardinalityConfig `yaml:"cardinality"`
+	Cost          CostConfig        `yaml:"cost"`
+}
+
+// ResultsCacheConfig 为范围查询结果缓存配置，max_freshness 内的最新数据不会被缓存
+type ResultsCacheConfig struct {
+	Enabled      bool          `yaml:"enabled"`
+	MaxEntries   int           `yaml:"max_entries"`
+	MaxSizeBytes int64         `yaml:"max_size_bytes"`
+	MaxFreshness time.Duration `yaml:"max_freshness"`
+}
+
+// QuerySplittingConfig 控制长范围查询按 interval 拆分并行执行，max_parallelism 为单个查询最多同时占用的并发槽位
+type QuerySplittingConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	Interval       time.Duration `yaml:"interval"`
+	MaxParallelism int           `yaml:"max_parallelism"`
+}
+
+// LoggingConfig 控制日志输出，format 为 json 或 logfmt，output 为 stdout、stderr 或 file
+type LoggingConfig struct {
+	Level  string        `yaml:"level"`
+	Format string        `yaml:"format"`
+	Output string        `yaml:"output"`
+	File   LogFileConfig `yaml:"file"`
+}
+
+// LogFileConfig 为日志文件及其轮转设置，max_backups 和 max_age_days 为 0 时保留全部旧文件
+type LogFileConfig struct {
+	Filename   string `yaml:"filename"`
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxBackups int    `yaml:"max_backups"`
+	MaxAgeDays int    `yaml:"max_age_days"`
+	Compress   bool   `yaml:"compress"`
+}
+
+// AuditConfig 控制审计日志，每个请求以一行 JSON 写入单独轮转的文件；
+// 被拒绝的请求全部记录，放行的请求按 allowed_sample_ratio 采样，为 0 时只记录被拒绝的请求
+type AuditConfig struct {
+	Enabled            bool          `yaml:"enabled"`
+	AllowedSampleRatio float64       `yaml:"allowed_sample_ratio"`
+	IdentityHeader     string        `yaml:"identity_header"`
+	File               LogFileConfig `yaml:"file"`
+}
+
+// CoalescingConfig 控制相同并发查询的合并，响应超过 max_body_bytes 时 followers 自行执行
+type CoalescingConfig struct {
+	Enabled      bool  `yaml:"enabled"`
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+}
+
+// ParserConfig 控制 PromQL 解析器接受的实验特性，应与后端 Prometheus 版本保持一致
+type ParserConfig struct {
+	EnableExperimentalFunctions bool     `yaml:"enable_experimental_functions"`
+	EnableDurationExpressions   bool     `yaml:"enable_duration_expressions"`
+	EnabledFunctions            []string `yaml:"enabled_functions"`
+	DisabledFunctions           []string `yaml:"disabled_functions"`
+}
+
+// CardinalityConfig 控制基于后端 series API 的基数预检
+type CardinalityConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	Lookback time.Duration `yaml:"lookback"`
+}
+
+// CostConfig 控制查询样本数估算，序列数查询复用 cardinality 的缓存配置
+type CostConfig struct {
+	Enabled        bool          `yaml:"enabled"`
+	ScrapeInterval time.Duration `yaml:"scrape_interval"`
+}
+
+// RateLimit 为令牌桶限速，Rate 为每秒请求数，Burst 为桶容量；Rate 为 0 表示不限速
+type RateLimit struct {
+	Rate  float64 `yaml:"rate"`
+	Burst int     `yaml:"burst"`
+}
+
+// RateLimitsConfig 控制按客户端 IP 与接口类别的限速，按租户的限速在 limits.rate_limit 中配置
+type RateLimitsConfig struct {
+	Enabled bool `yaml:"enabled"`
+	// ClientIPHeader 非空时从该请求头的第一个地址识别客户端，否则使用连接的远端地址
+	ClientIPHeader string               `yaml:"client_ip_header"`
+	PerClient      RateLimit            `yaml:"per_client"`
+	Endpoints      map[string]RateLimit `yaml:"endpoints"`
+}
+
+// LimitsConfig 为租户限额，零值表示不限制；tenants 中的配置覆盖默认 limits
+type LimitsConfig struct {
+	MaxSeries  int   `yaml:"max_series"`
+	MaxSamples int64 `yaml:"max_samples"`
+
+	MaxResponseBytes  int64 `yaml:"max_response_bytes"`
+	MaxResponseSeries int   `yaml:"max_response_series"`
+
+	QueryTimeout      time.Duration `yaml:"query_timeout"`
+	RangeQueryTimeout time.Duration `yaml:"range_query_timeout"`
+
+	// Weight 为公平调度的权重，MaxInflight 限制租户同时执行的请求数
+	Weight      float64 `yaml:"weight"`
+	MaxInflight int     `yaml:"max_inflight"`
+
+	RateLimit RateLimit `yaml:"rate_limit"`
+}
+
+// LimitsFor 返回指定租户生效的限额
+func (c *Config) LimitsFor(tenant string) LimitsConfig {
+	limits := c.Limits
+	override, ok := c.Tenants[tenant]
+	if !ok {
+		return limits
+	}
+
+	if override.MaxSeries != 0 {
+		limits.MaxSeries = override.MaxSeries
+	}
+	if override.MaxSamples != 0 {
+		limits.MaxSamples = override.MaxSamples
+	}
+	if override.MaxResponseBytes != 0 {
+		limits.MaxResponseBytes = override.MaxResponseBytes
+	}
+	if override.MaxResponseSeries != 0 {
+		limits.MaxResponseSeries = override.MaxResponseSeries
+	}
+	if override.QueryTimeout != 0 {
+		limits.QueryTimeout = override.QueryTimeout
+	}
+	if override.RangeQueryTimeout != 0 {
+		limits.RangeQueryTimeout = override.RangeQueryTimeout
+	}
+	if override.Weight != 0 {
+		limits.Weight = override.Weight
+	}
+	if override.MaxInflight != 0 {
+		limits.MaxInflight = override.MaxInflight
+	}
+	if override.RateLimit.Rate != 0 {
+		limits.RateLimit = override.RateLimit
+	}
+
+	return limits
 }
 
 func LoadFile(filename string) (*Config, error) {
@@ -30,11 +322,125 @@ func LoadFile(filename string) (*Config, error) {
 	if err != nil {
 		return nil, err
 	}
+	return Load(data)
+}
+
+// Load 解析 YAML 格式的配置并填充默认值
+func Load(data []byte) (*Config, error) {
+	data, err := expandEnv(data)
+	if err != nil {
+		return nil, err
+	}
 
 	var config Config
-	if err := yaml.Unmarshal(data, &config); err != nil {
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+
+	config.setDefaults()
+	if err := config.Validate(); err != nil {
 		return nil, err
 	}
 
 	return &config, nil
 }
+
+// setDefaults 为未配置的项填充默认值，显式配置的非法值留给 Validate 报错
+func (c *Config) setDefaults() {
+	if c.Server.Port == 0 {
+		c.Server.Port = 8080
+	}
+	if c.Server.MaxConcurrency == 0 {
+		c.Server.MaxConcurrency = 100
+	}
+	if c.Server.MaxQueueWait == 0 {
+		c.Server.MaxQueueWait = 30 * time.Second
+	}
+	if c.Server.DrainTimeout == 0 {
+		c.Server.DrainTimeout = 30 * time.Second
+	}
+	if c.Server.TenantHeader == "" {
+		c.Server.TenantHeader = DefaultTenantHeader
+	}
+	if c.Logging.Level == "" {
+		c.Logging.Level = "info"
+	}
+	if c.Logging.Format == "" {
+		c.Logging.Format = "json"
+	}
+	if c.Logging.Output == "" {
+		c.Logging.Output = "file"
+	}
+	if c.Logging.File.Filename == "" {
+		c.Logging.File.Filename = "promproxy.log"
+	}
+	if c.Logging.File.MaxSizeMB == 0 {
+		c.Logging.File.MaxSizeMB = 100
+	}
+	if c.Audit.File.Filename == "" {
+		c.Audit.File.Filename = "audit.jsonl"
+	}
+	if c.Audit.File.MaxSizeMB == 0 {
+		c.Audit.File.MaxSizeMB = 100
+	}
+	if c.Prometheus.HealthCheck.Path == "" {
+		c.Prometheus.HealthCheck.Path = "/-/ready"
+	}
+	if c.Prometheus.HealthCheck.Timeout == 0 {
+		c.Prometheus.HealthCheck.Timeout = 2 * time.Second
+	}
+	if c.Prometheus.PassiveHealth.EjectionTime == 0 {
+		c.Prometheus.PassiveHealth.EjectionTime = 30 * time.Second
+	}
+	if c.Prometheus.Client.DialTimeout == 0 {
+		c.Prometheus.Client.DialTimeout = 30 * time.Second
+	}
+	if c.Prometheus.Client.TLSHandshakeTimeout == 0 {
+		c.Prometheus.Client.TLSHandshakeTimeout = 10 * time.Second
+	}
+	if c.Prometheus.Client.IdleConnTimeout == 0 {
+		c.Prometheus.Client.IdleConnTimeout = 90 * time.Second
+	}
+	if c.Prometheus.Client.MaxIdleConns == 0 {
+		c.Prometheus.Client.MaxIdleConns = 100
+	}
+	if c.Prometheus.Client.MaxIdleConnsPerHost == 0 {
+		c.Prometheus.Client.MaxIdleConnsPerHost = 32
+	}
+	if c.Prometheus.Retry.InitialBackoff == 0 {
+		c.Prometheus.Retry.InitialBackoff = 100 * time.Millisecond
+	}
+	if c.Prometheus.Retry.MaxBackoff == 0 {
+		c.Prometheus.Retry.MaxBackoff = 2 * time.Second
+	}
+	if c.Prometheus.Breaker.FailureThreshold == 0 {
+		c.Prometheus.Breaker.FailureThreshold = 5
+	}
+	if c.Prometheus.Breaker.OpenDuration == 0 {
+		c.Prometheus.Breaker.OpenDuration = 30 * time.Second
+	}
+	if c.Prometheus.Breaker.HalfOpenRequests == 0 {
+		c.Prometheus.Breaker.HalfOpenRequests = 1
+	}
+	if c.Prometheus.Fanout.PartialResponse == "" {
+		c.Prometheus.Fanout.PartialResponse = "fail"
+	}
+	if c.Cache.MaxSizeBytes == 0 {
+		c.Cache.MaxSizeBytes = 128 << 20
+	}
+	if c.Cache.MaxFreshness == 0 {
+		c.Cache.MaxFreshness = 10 * time.Minute
+	}
+	if c.Splitting.Interval == 0 {
+		c.Splitting.Interval = time.Hour
+	}
+	if c.Splitting.MaxParallelism == 0 {
+		c.Splitting.MaxParallelism = 4
+	}
+	if c.Coalescing.MaxBodyBytes == 0 {
+		c.Coalescing.MaxBodyBytes = 16 << 20
+	}
+	if c.Prometheus.Forward.RequestHeaders.Deny == nil {
+		c.Prometheus.Forward.RequestHeaders.Deny = DefaultDeniedRequestHeaders
+	}
+}
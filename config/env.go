@@ -0,0 +1,91 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envPattern 匹配 ${VAR} 与 ${VAR:-default}，不处理 $VAR 形式，避免误改正则表达式中的 $
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandEnv 把配置中取值里的 ${VAR} 替换为环境变量的值。替换在解析 YAML 之后进行，
+// 环境变量中的 #、: 和换行等字符不会截断取值或注入配置项；注释和 key 不做替换。
+// 取值整体为一个引用且替换结果是数字或布尔值时按对应类型处理，以便用于端口等非字符串配置。
+// 引用了未设置且没有默认值的环境变量时返回错误
+func expandEnv(data []byte) ([]byte, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return nil, err
+	}
+
+	var missing []string
+	expanded := expandValue(doc, "", &missing)
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("unable to expand environment variables: %s", strings.Join(missing, "; "))
+	}
+	return yaml.Marshal(expanded)
+}
+
+func expandValue(value any, path string, missing *[]string) any {
+	switch v := value.(type) {
+	case yaml.MapSlice:
+		for i := range v {
+			v[i].Value = expandValue(v[i].Value, joinPath(path, fmt.Sprint(v[i].Key)), missing)
+		}
+		return v
+	case []any:
+		for i := range v {
+			v[i] = expandValue(v[i], fmt.Sprintf("%s[%d]", path, i), missing)
+		}
+		return v
+	case string:
+		return expandString(v, path, missing)
+	default:
+		return v
+	}
+}
+
+func expandString(s, path string, missing *[]string) any {
+	if !envPattern.MatchString(s) {
+		return s
+	}
+
+	expanded := envPattern.ReplaceAllStringFunc(s, func(match string) string {
+		groups := envPattern.FindStringSubmatch(match)
+		if value, ok := os.LookupEnv(groups[1]); ok {
+			return value
+		}
+		if groups[2] != "" {
+			return groups[3]
+		}
+		*missing = append(*missing, fmt.Sprintf("%s: environment variable %s is not set", path, groups[1]))
+		return match
+	})
+
+	if envPattern.FindString(s) != s {
+		return expanded
+	}
+	// 只转换格式化后与原文一致的取值，避免改变 0123、1e3 这类字符串
+	if n, err := strconv.ParseInt(expanded, 10, 64); err == nil && strconv.FormatInt(n, 10) == expanded {
+		return n
+	}
+	if f, err := strconv.ParseFloat(expanded, 64); err == nil && strconv.FormatFloat(f, 'f', -1, 64) == expanded {
+		return f
+	}
+	if expanded == "true" || expanded == "false" {
+		return expanded == "true"
+	}
+	return expanded
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
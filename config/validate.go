@@ -0,0 +1,237 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// ValidationError 汇总配置中的所有错误，每条错误以字段路径开头
+type ValidationError struct {
+	Errors []string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Errors) == 1 {
+		return e.Errors[0]
+	}
+	return fmt.Sprintf("%d errors: %s", len(e.Errors), strings.Join(e.Errors, "; "))
+}
+
+type validator struct {
+	errors []string
+}
+
+func (v *validator) errorf(path, format string, args ...any) {
+	v.errors = append(v.errors, path+": "+fmt.Sprintf(format, args...))
+}
+
+func (v *validator) positive(path string, value int) {
+	if value <= 0 {
+		v.errorf(path, "must be greater than 0, got %d", value)
+	}
+}
+
+func (v *validator) nonNegative(path string, value int64) {
+	if value < 0 {
+		v.errorf(path, "must not be negative, got %d", value)
+	}
+}
+
+func (v *validator) duration(path string, value time.Duration) {
+	if value < 0 {
+		v.errorf(path, "must not be negative, got %s", value)
+	}
+}
+
+func (v *validator) oneOf(path, value string, allowed ...string) {
+	if !slices.Contains(allowed, value) {
+		v.errorf(path, "must be one of %s, got %q", strings.Join(allowed, ", "), value)
+	}
+}
+
+func (v *validator) url(path, raw string) {
+	u, err := url.Parse(raw)
+	if err != nil {
+		v.errorf(path, "invalid URL %q: %v", raw, err)
+		return
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.errorf(path, "URL %q must be an absolute http or https URL", raw)
+	}
+}
+
+// Validate 检查配置的取值，返回包含所有错误的 ValidationError
+func (c *Config) Validate() error {
+	v := &validator{}
+
+	v.positive("server.port", c.Server.Port)
+	if c.Server.Port > 65535 {
+		v.errorf("server.port", "must be at most 65535, got %d", c.Server.Port)
+	}
+	v.positive("server.max_concurrency", c.Server.MaxConcurrency)
+	v.nonNegative("server.admin_port", int64(c.Server.AdminPort))
+	if c.Server.AdminPort > 65535 {
+		v.errorf("server.admin_port", "must be at most 65535, got %d", c.Server.AdminPort)
+	} else if c.Server.AdminPort != 0 && c.Server.AdminPort == c.Server.Port {
+		v.errorf("server.admin_port", "must differ from server.port %d", c.Server.Port)
+	}
+	v.nonNegative("server.max_queue_length", int64(c.Server.MaxQueueLength))
+	v.duration("server.max_queue_wait", c.Server.MaxQueueWait)
+	v.duration("server.shutdown_delay", c.Server.ShutdownDelay)
+	v.duration("server.drain_timeout", c.Server.DrainTimeout)
+	v.duration("server.reload.watch_interval", c.Server.Reload.WatchInterval)
+
+	c.Prometheus.validate(v)
+
+	v.duration("rules.cardinality.cache_ttl", c.Rules.Cardinality.CacheTTL)
+	v.duration("rules.cardinality.lookback", c.Rules.Cardinality.Lookback)
+	v.duration("rules.cost.scrape_interval", c.Rules.Cost.ScrapeInterval)
+
+	v.nonNegative("results_cache.max_entries", int64(c.Cache.MaxEntries))
+	v.nonNegative("results_cache.max_size_bytes", c.Cache.MaxSizeBytes)
+	v.duration("results_cache.max_freshness", c.Cache.MaxFreshness)
+	v.duration("query_splitting.interval", c.Splitting.Interval)
+	v.positive("query_splitting.max_parallelism", c.Splitting.MaxParallelism)
+	v.nonNegative("coalescing.max_body_bytes", c.Coalescing.MaxBodyBytes)
+
+	validateRateLimit(v, "rate_limits.per_client", c.RateLimits.PerClient)
+	for _, class := range sortedKeys(c.RateLimits.Endpoints) {
+		path := "rate_limits.endpoints." + class
+		v.oneOf(path, class, "query", "query_range", "metadata", "other")
+		validateRateLimit(v, path, c.RateLimits.Endpoints[class])
+	}
+
+	v.oneOf("logging.level", c.Logging.Level, "debug", "info", "warn", "error")
+	v.oneOf("logging.format", c.Logging.Format, "json", "logfmt")
+	v.oneOf("logging.output", c.Logging.Output, "stdout", "stderr", "file")
+	v.positive("logging.file.max_size_mb", c.Logging.File.MaxSizeMB)
+	v.nonNegative("logging.file.max_backups", int64(c.Logging.File.MaxBackups))
+	v.nonNegative("logging.file.max_age_days", int64(c.Logging.File.MaxAgeDays))
+
+	if c.Audit.AllowedSampleRatio < 0 || c.Audit.AllowedSampleRatio > 1 {
+		v.errorf("audit.allowed_sample_ratio", "must be between 0 and 1, got %v", c.Audit.AllowedSampleRatio)
+	}
+	v.positive("audit.file.max_size_mb", c.Audit.File.MaxSizeMB)
+	v.nonNegative("audit.file.max_backups", int64(c.Audit.File.MaxBackups))
+	v.nonNegative("audit.file.max_age_days", int64(c.Audit.File.MaxAgeDays))
+
+	c.Limits.validate(v, "limits")
+	for _, tenant := range sortedKeys(c.Tenants) {
+		limits := c.Tenants[tenant]
+		limits.validate(v, "tenants."+tenant)
+	}
+
+	if len(v.errors) > 0 {
+		return &ValidationError{Errors: v.errors}
+	}
+	return nil
+}
+
+func (p *PrometheusConfig) validate(v *validator) {
+	strategies := []string{"round_robin", "least_inflight", "primary_standby"}
+
+	if len(p.BackendURLs()) == 0 {
+		v.errorf("prometheus.url", "either url or endpoints must be configured")
+	}
+	if p.URL != "" && len(p.Endpoints) == 0 {
+		v.url("prometheus.url", p.URL)
+	}
+	for i, endpoint := range p.Endpoints {
+		v.url(fmt.Sprintf("prometheus.endpoints[%d]", i), endpoint)
+	}
+	if p.Strategy != "" {
+		v.oneOf("prometheus.strategy", p.Strategy, strategies...)
+	}
+
+	v.duration("prometheus.health_check.interval", p.HealthCheck.Interval)
+	v.duration("prometheus.health_check.timeout", p.HealthCheck.Timeout)
+	v.nonNegative("prometheus.passive_health.max_failures", int64(p.PassiveHealth.MaxFailures))
+	v.duration("prometheus.passive_health.ejection_time", p.PassiveHealth.EjectionTime)
+
+	client := p.Client
+	if (client.TLS.CertFile == "") != (client.TLS.KeyFile == "") {
+		v.errorf("prometheus.client.tls", "cert_file and key_file must be configured together")
+	}
+	if client.BasicAuth != nil && (client.BearerToken != "" || client.BearerTokenFile != "") {
+		v.errorf("prometheus.client", "basic_auth and bearer_token cannot both be configured")
+	}
+	if client.BasicAuth != nil && client.BasicAuth.Password != "" && client.BasicAuth.PasswordFile != "" {
+		v.errorf("prometheus.client.basic_auth", "password and password_file cannot both be configured")
+	}
+	if client.BearerToken != "" && client.BearerTokenFile != "" {
+		v.errorf("prometheus.client", "bearer_token and bearer_token_file cannot both be configured")
+	}
+	v.duration("prometheus.client.dial_timeout", client.DialTimeout)
+	v.duration("prometheus.client.tls_handshake_timeout", client.TLSHandshakeTimeout)
+	v.duration("prometheus.client.response_header_timeout", client.ResponseHeaderTimeout)
+	v.duration("prometheus.client.idle_conn_timeout", client.IdleConnTimeout)
+	v.nonNegative("prometheus.client.max_idle_conns", int64(client.MaxIdleConns))
+	v.nonNegative("prometheus.client.max_idle_conns_per_host", int64(client.MaxIdleConnsPerHost))
+	v.nonNegative("prometheus.client.max_conns_per_host", int64(client.MaxConnsPerHost))
+
+	v.nonNegative("prometheus.retry.max_attempts", int64(p.Retry.MaxAttempts))
+	v.duration("prometheus.retry.initial_backoff", p.Retry.InitialBackoff)
+	v.duration("prometheus.retry.max_backoff", p.Retry.MaxBackoff)
+	v.positive("prometheus.circuit_breaker.failure_threshold", p.Breaker.FailureThreshold)
+	v.duration("prometheus.circuit_breaker.open_duration", p.Breaker.OpenDuration)
+	v.positive("prometheus.circuit_breaker.half_open_requests", p.Breaker.HalfOpenRequests)
+
+	routed := make(map[string]int)
+	for i, route := range p.Routes {
+		path := fmt.Sprintf("prometheus.routes[%d]", i)
+		if len(route.Spaces) == 0 {
+			v.errorf(path+".spaces", "must not be empty")
+		}
+		for _, space := range route.Spaces {
+			if j, ok := routed[space]; ok {
+				v.errorf(path+".spaces", "space %q is already routed by prometheus.routes[%d]", space, j)
+			}
+			routed[space] = i
+		}
+		if len(route.Endpoints) == 0 {
+			v.errorf(path+".endpoints", "must not be empty")
+		}
+		for j, endpoint := range route.Endpoints {
+			v.url(fmt.Sprintf("%s.endpoints[%d]", path, j), endpoint)
+		}
+		if route.Strategy != "" {
+			v.oneOf(path+".strategy", route.Strategy, strategies...)
+		}
+	}
+
+	v.oneOf("prometheus.fanout.partial_response", p.Fanout.PartialResponse, "fail", "warn")
+}
+
+func (l *LimitsConfig) validate(v *validator, path string) {
+	v.nonNegative(path+".max_series", int64(l.MaxSeries))
+	v.nonNegative(path+".max_samples", l.MaxSamples)
+	v.nonNegative(path+".max_response_bytes", l.MaxResponseBytes)
+	v.nonNegative(path+".max_response_series", int64(l.MaxResponseSeries))
+	v.duration(path+".query_timeout", l.QueryTimeout)
+	v.duration(path+".range_query_timeout", l.RangeQueryTimeout)
+	if l.Weight < 0 {
+		v.errorf(path+".weight", "must not be negative, got %g", l.Weight)
+	}
+	v.nonNegative(path+".max_inflight", int64(l.MaxInflight))
+	validateRateLimit(v, path+".rate_limit", l.RateLimit)
+}
+
+func validateRateLimit(v *validator, path string, limit RateLimit) {
+	if limit.Rate < 0 {
+		v.errorf(path+".rate", "must not be negative, got %g", limit.Rate)
+	}
+	v.nonNegative(path+".burst", int64(limit.Burst))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,132 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const defaultLookback = 5 * time.Minute
+
+const cardinalityName = "cardinality"
+
+type CardinalityMiddleware struct {
+	Counter   SeriesCounter
+	MaxSeries func(tenant string) int
+	Lookback  time.Duration
+}
+
+func NewCardinalityMiddleware(counter SeriesCounter, maxSeries func(tenant string) int, lookback time.Duration) *CardinalityMiddleware {
+	if lookback <= 0 {
+		lookback = defaultLookback
+	}
+	return &CardinalityMiddleware{
+		Counter:   counter,
+		MaxSeries: maxSeries,
+		Lookback:  lookback,
+	}
+}
+
+func (c *CardinalityMiddleware) Process(ctx *RequestContext) error {
+	return c.validateCardinality(ctx)
+}
+
+func (c *CardinalityMiddleware) queriesBackend() {}
+
+func (c *CardinalityMiddleware) validateCardinality(ctx *RequestContext) error {
+	budget := c.MaxSeries(ctx.Tenant)
+	if budget <= 0 {
+		return nil
+	}
+
+	reqCtx := context.Background()
+	if ctx.Request != nil {
+		reqCtx = ctx.Request.Context()
+	}
+
+	start, end := queryWindow(ctx)
+	total := 0
+	for _, sel := range selectorWindows(ctx.ParsedAST, c.Lookback) {
+		// 多取一条以判断是否超出预算
+		count, err := c.Counter.CountSeries(reqCtx, sel.selector, start.Add(-sel.lookback), end, budget+1)
+		if err != nil {
+			return validationErrorf(KindUnavailable, "cardinality check for %s failed: %v", sel.selector, err)
+		}
+		total += count
+		if total > budget {
+			return Violations{{
+				Middleware: cardinalityName,
+				Rule:       "max_series",
+				Kind:       KindLimit,
+				Node:       sel.selector,
+				Message:    fmt.Sprintf("query matches more than %d series allowed for tenant %q", budget, ctx.Tenant),
+				Suggestion: "narrow the label selectors",
+			}}
+		}
+	}
+
+	return nil
+}
+
+type selectorWindow struct {
+	selector string
+	lookback time.Duration
+}
+
+// selectorWindows 返回查询中去重后的选择器及其需要回看的时间
+func selectorWindows(expr parser.Expr, lookback time.Duration) []selectorWindow {
+	var windows []selectorWindow
+	index := make(map[string]int)
+
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		back, extra := lookback, vs.OriginalOffset
+		for _, p := range path {
+			switch n := p.(type) {
+			case *parser.MatrixSelector:
+				back = n.Range
+			case *parser.SubqueryExpr:
+				extra += n.Range + n.OriginalOffset
+			}
+		}
+		back += extra
+
+		selector := matchersString(vs)
+		if i, ok := index[selector]; ok {
+			windows[i].lookback = max(windows[i].lookback, back)
+			return nil
+		}
+		index[selector] = len(windows)
+		windows = append(windows, selectorWindow{selector: selector, lookback: back})
+		return nil
+	})
+
+	return windows
+}
+
+func matchersString(vs *parser.VectorSelector) string {
+	matchers := make([]string, 0, len(vs.LabelMatchers))
+	for _, m := range vs.LabelMatchers {
+		matchers = append(matchers, m.String())
+	}
+	return "{" + strings.Join(matchers, ",") + "}"
+}
+
+// queryWindow 返回请求的求值时间范围
+func queryWindow(ctx *RequestContext) (time.Time, time.Time) {
+	if ctx.IsRange && ctx.StartTime != nil && ctx.EndTime != nil {
+		return *ctx.StartTime, *ctx.EndTime
+	}
+	if ctx.Timestamp != nil {
+		return *ctx.Timestamp, *ctx.Timestamp
+	}
+	now := time.Now()
+	return now, now
+}
@@ -2,6 +2,7 @@ package middleware
 
 import (
 	"net/http"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/prometheus/promql/parser"
@@ -10,10 +11,30 @@ import (
 type RequestContext struct {
 	Query     string
 	ParsedAST parser.Expr
+	Spaces    []string
 	StartTime *time.Time
 	EndTime   *time.Time
 	Timestamp *time.Time
 	Step      string
 	IsRange   bool
+	Tenant    string
+	Cost      *CostEstimate
 	Request   *http.Request
+	// Now 为校验时间范围使用的当前时间，零值表示 time.Now()；离线重放时为请求被记录的时间
+	Now time.Time
+}
+
+func (ctx *RequestContext) now() time.Time {
+	if ctx.Now.IsZero() {
+		return time.Now()
+	}
+	return ctx.Now
+}
+
+// parseStep 解析 step 参数，支持浮点秒数和 Go duration 两种格式
+func parseStep(step string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(step, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	return time.ParseDuration(step)
 }
@@ -0,0 +1,186 @@
+package middleware
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const (
+	defaultScrapeInterval = 15 * time.Second
+	defaultSubqueryStep   = time.Minute
+	defaultRangeQueryStep = time.Minute
+)
+
+type SelectorCost struct {
+	Selector string `json:"selector"`
+	Series   int    `json:"series"`
+	Samples  int64  `json:"samples"`
+}
+
+type CostEstimate struct {
+	Samples   int64          `json:"samples"`
+	Series    int            `json:"series"`
+	Steps     int64          `json:"steps"`
+	Truncated bool           `json:"truncated"`
+	Selectors []SelectorCost `json:"selectors"`
+}
+
+// CostEstimator 以 匹配序列数 × 每次求值读取的样本数 × 求值次数 估算查询代价
+type CostEstimator struct {
+	Counter        SeriesCounter
+	ScrapeInterval time.Duration
+	Lookback       time.Duration
+}
+
+func NewCostEstimator(counter SeriesCounter, scrapeInterval, lookback time.Duration) *CostEstimator {
+	if scrapeInterval <= 0 {
+		scrapeInterval = defaultScrapeInterval
+	}
+	if lookback <= 0 {
+		lookback = defaultLookback
+	}
+	return &CostEstimator{
+		Counter:        counter,
+		ScrapeInterval: scrapeInterval,
+		Lookback:       lookback,
+	}
+}
+
+// Estimate 估算查询扫描的样本数，budget > 0 时序列查询会按预算截断
+func (e *CostEstimator) Estimate(ctx *RequestContext, budget int64) (*CostEstimate, error) {
+	reqCtx := context.Background()
+	if ctx.Request != nil {
+		reqCtx = ctx.Request.Context()
+	}
+
+	estimate := &CostEstimate{Steps: querySteps(ctx)}
+	start, end := queryWindow(ctx)
+
+	for _, sel := range e.selectorCosts(ctx.ParsedAST) {
+		limit := 0
+		if budget > 0 && sel.points*estimate.Steps > 0 {
+			limit = int(budget/(sel.points*estimate.Steps)) + 1
+		}
+
+		series, err := e.Counter.CountSeries(reqCtx, sel.selector, start.Add(-sel.lookback), end, limit)
+		if err != nil {
+			return nil, fmt.Errorf("cost estimation for %s failed: %v", sel.selector, err)
+		}
+		if limit > 0 && series >= limit {
+			estimate.Truncated = true
+		}
+
+		samples := int64(series) * sel.points * estimate.Steps
+		estimate.Series += series
+		estimate.Samples += samples
+		estimate.Selectors = append(estimate.Selectors, SelectorCost{
+			Selector: sel.selector,
+			Series:   series,
+			Samples:  samples,
+		})
+	}
+
+	return estimate, nil
+}
+
+type selectorCost struct {
+	selector string
+	lookback time.Duration
+	points   int64
+}
+
+func (e *CostEstimator) selectorCosts(expr parser.Expr) []selectorCost {
+	var costs []selectorCost
+
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+
+		back, extra := e.Lookback, vs.OriginalOffset
+		points := int64(1)
+		for _, p := range path {
+			switch n := p.(type) {
+			case *parser.MatrixSelector:
+				back = n.Range
+				points *= max(int64(n.Range/e.ScrapeInterval), 1)
+			case *parser.SubqueryExpr:
+				extra += n.Range + n.OriginalOffset
+				step := n.Step
+				if step <= 0 {
+					step = defaultSubqueryStep
+				}
+				points *= max(int64(n.Range/step), 1)
+			}
+		}
+
+		costs = append(costs, selectorCost{
+			selector: matchersString(vs),
+			lookback: back + extra,
+			points:   points,
+		})
+		return nil
+	})
+
+	return costs
+}
+
+// querySteps 返回请求的求值次数，即时查询为 1，范围查询最少为 1
+func querySteps(ctx *RequestContext) int64 {
+	if !ctx.IsRange || ctx.StartTime == nil || ctx.EndTime == nil {
+		return 1
+	}
+
+	step, err := parseStep(ctx.Step)
+	if err != nil || step <= 0 {
+		step = defaultRangeQueryStep
+	}
+	return max(int64(ctx.EndTime.Sub(*ctx.StartTime)/step)+1, 1)
+}
+
+const costName = "cost"
+
+type CostMiddleware struct {
+	Estimator  *CostEstimator
+	MaxSamples func(tenant string) int64
+}
+
+func NewCostMiddleware(estimator *CostEstimator, maxSamples func(tenant string) int64) *CostMiddleware {
+	return &CostMiddleware{
+		Estimator:  estimator,
+		MaxSamples: maxSamples,
+	}
+}
+
+func (c *CostMiddleware) Process(ctx *RequestContext) error {
+	return c.validateCost(ctx)
+}
+
+func (c *CostMiddleware) queriesBackend() {}
+
+func (c *CostMiddleware) validateCost(ctx *RequestContext) error {
+	budget := c.MaxSamples(ctx.Tenant)
+
+	estimate, err := c.Estimator.Estimate(ctx, budget)
+	if err != nil {
+		return &ValidationError{Kind: KindUnavailable, Err: err}
+	}
+	ctx.Cost = estimate
+
+	if budget > 0 && estimate.Samples > budget {
+		return Violations{{
+			Middleware: costName,
+			Rule:       "max_samples",
+			Kind:       KindLimit,
+			Message: fmt.Sprintf("query would scan about %d samples, exceeding the budget of %d for tenant %q",
+				estimate.Samples, budget, ctx.Tenant),
+			Suggestion: "shorten the time range, increase the step or narrow the label selectors",
+		}}
+	}
+
+	return nil
+}
@@ -0,0 +1,71 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+type fixedSeriesCounter int
+
+func (c fixedSeriesCounter) CountSeries(context.Context, string, time.Time, time.Time, int) (int, error) {
+	return int(c), nil
+}
+
+func TestQuerySteps(t *testing.T) {
+	start := time.Unix(1000, 0)
+	at := func(d time.Duration) *time.Time {
+		ts := start.Add(d)
+		return &ts
+	}
+
+	tests := []struct {
+		name string
+		ctx  *RequestContext
+		want int64
+	}{
+		{"instant", &RequestContext{}, 1},
+		{"range", &RequestContext{IsRange: true, StartTime: at(0), EndTime: at(time.Hour), Step: "1m"}, 61},
+		{"float step", &RequestContext{IsRange: true, StartTime: at(0), EndTime: at(time.Hour), Step: "60"}, 61},
+		{"missing step", &RequestContext{IsRange: true, StartTime: at(0), EndTime: at(time.Hour)}, 61},
+		{"end before start", &RequestContext{IsRange: true, StartTime: at(time.Minute), EndTime: at(0), Step: "1m"}, 1},
+		{"end long before start", &RequestContext{IsRange: true, StartTime: at(time.Hour), EndTime: at(0), Step: "1m"}, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := querySteps(tt.ctx); got != tt.want {
+				t.Errorf("got %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCostEndBeforeStart(t *testing.T) {
+	expr, err := parser.ParseExpr(`up{space="production"}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Unix(1000, 0)
+	end := start.Add(-time.Minute)
+	ctx := &RequestContext{ParsedAST: expr, IsRange: true, StartTime: &start, EndTime: &end, Step: "1m"}
+
+	estimator := NewCostEstimator(fixedSeriesCounter(10), 0, 0)
+	estimate, err := estimator.Estimate(ctx, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if estimate.Steps != 1 {
+		t.Errorf("got %d steps, want 1", estimate.Steps)
+	}
+
+	// 范围校验在基数和成本校验之前拒绝这类请求
+	err = Process([]Middleware{NewQueryRangeMiddleware(), NewCostMiddleware(estimator, func(string) int64 { return 1000 })}, ctx)
+	var violations Violations
+	if !errors.As(err, &violations) || len(violations) != 1 || violations[0].Rule != "invalid_range" || violations.Kind() != KindInvalid {
+		t.Errorf("got %v, want a single invalid_range violation", err)
+	}
+}
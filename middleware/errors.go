@@ -0,0 +1,35 @@
+package middleware
+
+import "fmt"
+
+// ErrorKind 为校验失败的类别，代理据此选择返回的状态码
+type ErrorKind int
+
+const (
+	// KindInvalid 表示请求本身不合法，例如参数格式错误
+	KindInvalid ErrorKind = iota
+	// KindDenied 表示请求违反访问策略，例如访问未授权的 space
+	KindDenied
+	// KindLimit 表示请求超出限额，例如查询范围、序列数或样本数
+	KindLimit
+	// KindUnavailable 表示校验依赖的后端查询失败
+	KindUnavailable
+)
+
+// ValidationError 为中间件返回的校验错误
+type ValidationError struct {
+	Kind ErrorKind
+	Err  error
+}
+
+func (e *ValidationError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ValidationError) Unwrap() error {
+	return e.Err
+}
+
+func validationErrorf(kind ErrorKind, format string, args ...any) error {
+	return &ValidationError{Kind: kind, Err: fmt.Errorf(format, args...)}
+}
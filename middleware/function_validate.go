@@ -8,6 +8,8 @@ import (
 	"github.com/prometheus/prometheus/promql/parser"
 )
 
+const functionValidateName = "function_validate"
+
 type FunctionValidateMiddleware struct{}
 
 func NewFunctionValidateMiddleware() *FunctionValidateMiddleware {
@@ -19,61 +21,49 @@ func (f *FunctionValidateMiddleware) Process(ctx *RequestContext) error {
 }
 
 func (f *FunctionValidateMiddleware) validatePromQLFunctions(ctx *RequestContext) error {
-	var errors []string
+	var violations Violations
 
 	// 遍历AST查找函数调用
 	parser.Inspect(ctx.ParsedAST, func(node parser.Node, path []parser.Node) error {
 		if call, ok := node.(*parser.Call); ok {
-			switch call.Func.Name {
-			case "increase":
-				if err := f.validateIncreaseFunction(call); err != nil {
-					errors = append(errors, err.Error())
-				}
-			default:
-				// 检查_over_time函数
-				if strings.HasSuffix(call.Func.Name, "_over_time") {
-					if err := f.validateOverTimeFunction(call); err != nil {
-						errors = append(errors, err.Error())
-					}
+			// 检查 increase 和 _over_time 函数
+			if call.Func.Name == "increase" || strings.HasSuffix(call.Func.Name, "_over_time") {
+				if v := f.validateRangeFunction(call); v != nil {
+					violations = append(violations, v.at(ctx, call))
 				}
 			}
 		}
 		return nil
 	})
 
-	if len(errors) > 0 {
-		return fmt.Errorf("function validation errors: %s", strings.Join(errors, "; "))
+	if len(violations) > 0 {
+		return violations
 	}
 
 	return nil
 }
 
-func (f *FunctionValidateMiddleware) validateIncreaseFunction(call *parser.Call) error {
+func (f *FunctionValidateMiddleware) validateRangeFunction(call *parser.Call) *Violation {
 	if len(call.Args) == 0 {
-		return fmt.Errorf("increase function requires arguments")
-	}
-
-	// 检查第一个参数是否为MatrixSelector
-	if ms, ok := call.Args[0].(*parser.MatrixSelector); ok {
-		duration := time.Duration(ms.Range)
-		if duration > 24*time.Hour {
-			return fmt.Errorf("increase function time range %v cannot exceed 24h", duration)
+		return &Violation{
+			Middleware: functionValidateName,
+			Rule:       "function_missing_argument",
+			Kind:       KindInvalid,
+			Message:    fmt.Sprintf("%s function requires arguments", call.Func.Name),
 		}
 	}
 
-	return nil
-}
-
-func (f *FunctionValidateMiddleware) validateOverTimeFunction(call *parser.Call) error {
-	if len(call.Args) == 0 {
-		return fmt.Errorf("%s function requires arguments", call.Func.Name)
-	}
-
 	// 检查第一个参数是否为MatrixSelector
 	if ms, ok := call.Args[0].(*parser.MatrixSelector); ok {
 		duration := time.Duration(ms.Range)
 		if duration > 24*time.Hour {
-			return fmt.Errorf("%s function time range %v cannot exceed 24h", call.Func.Name, duration)
+			return &Violation{
+				Middleware: functionValidateName,
+				Rule:       "function_range_too_long",
+				Kind:       KindLimit,
+				Message:    fmt.Sprintf("%s function time range %v cannot exceed 24h", call.Func.Name, duration),
+				Suggestion: "reduce the range to 24h or less and use a range query to cover longer periods",
+			}
 		}
 	}
 
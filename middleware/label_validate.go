@@ -9,6 +9,8 @@ import (
 	"github.com/prometheus/prometheus/promql/parser"
 )
 
+const labelValidateName = "label_validate"
+
 type LabelValidateMiddleware struct {
 	AllowedSpaces []string
 }
@@ -24,67 +26,82 @@ func (m *LabelValidateMiddleware) Process(ctx *RequestContext) error {
 }
 
 func (m *LabelValidateMiddleware) validateSpaceLabel(ctx *RequestContext) error {
-	type foundSpace struct {
-		spaceValue string
-		matcher    string
-		valid      bool
-	}
-
-	var foundSpaces []foundSpace
+	var violations Violations
+	selectors := 0
 
 	// 遍历AST查找所有的VectorSelector
 	parser.Inspect(ctx.ParsedAST, func(node parser.Node, path []parser.Node) error {
-		if vs, ok := node.(*parser.VectorSelector); ok {
-			spaceFound := false
-			for _, matcher := range vs.LabelMatchers {
-				if matcher.Name == "space" {
-					spaceFound = true
+		vs, ok := node.(*parser.VectorSelector)
+		if !ok {
+			return nil
+		}
+		selectors++
 
-					if matcher.Type == labels.MatchEqual {
-						hasValidSpace := slices.Contains(m.AllowedSpaces, matcher.Value)
-						foundSpaces = append(foundSpaces, foundSpace{
-							spaceValue: matcher.Value,
-							matcher:    matcher.Type.String(),
-							valid:      hasValidSpace})
-					} else if matcher.Type == labels.MatchRegexp {
-						values := strings.Split(matcher.Value, "|")
-						allVaild := true
-						for _, value := range values {
-							if !slices.Contains(m.AllowedSpaces, value) {
-								allVaild = false
-								break
-							}
-						}
-						foundSpaces = append(foundSpaces, foundSpace{
-							spaceValue: matcher.Value,
-							matcher:    matcher.Type.String(),
-							valid:      allVaild})
-					}
-				}
+		spaceFound := false
+		for _, matcher := range vs.LabelMatchers {
+			if matcher.Name != "space" {
+				continue
+			}
+			spaceFound = true
+
+			var values []string
+			switch matcher.Type {
+			case labels.MatchEqual:
+				values = []string{matcher.Value}
+			case labels.MatchRegexp:
+				values = strings.Split(matcher.Value, "|")
+			default:
+				// != 和 !~ 会匹配未授权的 space
+				violations = append(violations, Violation{
+					Middleware: labelValidateName,
+					Rule:       "space_not_allowed",
+					Kind:       KindDenied,
+					Message:    fmt.Sprintf("space matcher %v is not allowed, only = and =~ can be used", matcher.Type),
+					Suggestion: fmt.Sprintf("select the spaces explicitly, for example {space=~\"%s\"}", strings.Join(m.AllowedSpaces, "|")),
+				}.at(ctx, vs))
+				continue
 			}
 
-			if !spaceFound {
-				foundSpaces = append(foundSpaces, foundSpace{
-					spaceValue: "<missing>",
-					matcher:    " ",
-					valid:      false})
+			var denied []string
+			for _, value := range values {
+				if !slices.Contains(m.AllowedSpaces, value) {
+					denied = append(denied, value)
+				}
+			}
+			if len(denied) > 0 {
+				violations = append(violations, Violation{
+					Middleware: labelValidateName,
+					Rule:       "space_not_allowed",
+					Kind:       KindDenied,
+					Message:    fmt.Sprintf("space values %v with matcher %v are not allowed", matcher.Value, matcher.Type),
+					Suggestion: fmt.Sprintf("query one of the allowed spaces: %s", strings.Join(m.AllowedSpaces, ", ")),
+				}.at(ctx, vs))
 			}
 		}
+
+		if !spaceFound {
+			violations = append(violations, Violation{
+				Middleware: labelValidateName,
+				Rule:       "space_label_missing",
+				Kind:       KindDenied,
+				Message:    "all metrics in the query must have a 'space' label",
+				Suggestion: `add a space matcher to the selector, for example {space="production"}`,
+			}.at(ctx, vs))
+		}
 		return nil
 	})
 
-	if len(foundSpaces) == 0 {
-		return fmt.Errorf("query must contain at least one metric with a 'space' label")
+	if selectors == 0 {
+		violations = append(violations, Violation{
+			Middleware: labelValidateName,
+			Rule:       "space_selector_missing",
+			Kind:       KindDenied,
+			Message:    "query must contain at least one metric with a 'space' label",
+		}.at(ctx, ctx.ParsedAST))
 	}
 
-	for _, s := range foundSpaces {
-		if s.spaceValue == "<missing>" {
-			return fmt.Errorf("all metrics in the query must have a 'space' label")
-		}
-		if !s.valid {
-			return fmt.Errorf("space values %v with matcher %v are not allowed", s.spaceValue, s.matcher)
-		}
+	if len(violations) > 0 {
+		return violations
 	}
-
 	return nil
 }
@@ -0,0 +1,51 @@
+package middleware
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func TestLabelValidate(t *testing.T) {
+	m := NewLabelValidateMiddleware([]string{"production", "staging"})
+
+	tests := []struct {
+		query string
+		rules []string
+	}{
+		{`up{space="production"}`, nil},
+		{`up{space=~"production|staging"}`, nil},
+		{`up{space="secret"}`, []string{"space_not_allowed"}},
+		{`up{space=~"production|secret"}`, []string{"space_not_allowed"}},
+		{`up{space!="production"}`, []string{"space_not_allowed"}},
+		{`up{space!~"x"}`, []string{"space_not_allowed"}},
+		{`up{space="production", space!="staging"}`, []string{"space_not_allowed"}},
+		{`up`, []string{"space_label_missing"}},
+		{`up{space="secret"} + foo`, []string{"space_not_allowed", "space_label_missing"}},
+		{`1 + 1`, []string{"space_selector_missing"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			expr, err := parser.ParseExpr(tt.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = m.Process(&RequestContext{Query: tt.query, ParsedAST: expr})
+
+			var violations Violations
+			if err != nil && !errors.As(err, &violations) {
+				t.Fatalf("unexpected error %v", err)
+			}
+			if len(violations) != len(tt.rules) {
+				t.Fatalf("got violations %v, want rules %v", violations, tt.rules)
+			}
+			for i, v := range violations {
+				if v.Rule != tt.rules[i] || v.Kind != KindDenied {
+					t.Errorf("violation %d: got %s (kind %v), want %s", i, v.Rule, v.Kind, tt.rules[i])
+				}
+			}
+		})
+	}
+}
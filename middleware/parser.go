@@ -0,0 +1,131 @@
+package middleware
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+func init() {
+	// 解析器的实验特性开关是包级全局变量，这里全部打开，
+	// 再由 QueryParser 按配置对解析结果做检查，以便给出明确的错误信息
+	parser.EnableExperimentalFunctions = true
+	parser.ExperimentalDurationExpr = true
+}
+
+type ParserOptions struct {
+	ExperimentalFunctions bool
+	DurationExpressions   bool
+	EnabledFunctions      []string
+	DisabledFunctions     []string
+}
+
+// QueryParser 按配置的特性开关解析 PromQL，零值只接受稳定特性
+type QueryParser struct {
+	options ParserOptions
+}
+
+func NewQueryParser(options ParserOptions) (*QueryParser, error) {
+	for _, name := range slices.Concat(options.EnabledFunctions, options.DisabledFunctions) {
+		if _, ok := parser.Functions[name]; !ok && !isAggregator(name) {
+			return nil, fmt.Errorf("unknown PromQL function %q", name)
+		}
+	}
+	for _, name := range options.DisabledFunctions {
+		if slices.Contains(options.EnabledFunctions, name) {
+			return nil, fmt.Errorf("function %q is both enabled and disabled", name)
+		}
+	}
+
+	return &QueryParser{
+		options: options,
+	}, nil
+}
+
+func (q *QueryParser) ParseExpr(query string) (parser.Expr, error) {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PromQL syntax: %v", err)
+	}
+
+	if err := q.checkFeatures(query, expr); err != nil {
+		return nil, err
+	}
+
+	return expr, nil
+}
+
+func (q *QueryParser) checkFeatures(query string, expr parser.Expr) error {
+	var errors []string
+
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.Call:
+			if err := q.checkFunction(n.Func.Name, n.Func.Experimental); err != nil {
+				errors = append(errors, positioned(query, n, err))
+			}
+		case *parser.AggregateExpr:
+			if err := q.checkFunction(n.Op.String(), n.Op.IsExperimentalAggregator()); err != nil {
+				errors = append(errors, positioned(query, n, err))
+			}
+		case *parser.VectorSelector:
+			if n.OriginalOffsetExpr != nil {
+				errors = append(errors, q.checkDurationExpr(query, n))
+			}
+		case *parser.MatrixSelector:
+			if n.RangeExpr != nil {
+				errors = append(errors, q.checkDurationExpr(query, n))
+			}
+		case *parser.SubqueryExpr:
+			if n.RangeExpr != nil || n.StepExpr != nil || n.OriginalOffsetExpr != nil {
+				errors = append(errors, q.checkDurationExpr(query, n))
+			}
+		}
+		return nil
+	})
+
+	errors = slices.DeleteFunc(errors, func(s string) bool { return s == "" })
+	if len(errors) > 0 {
+		return fmt.Errorf("unsupported PromQL feature: %s", strings.Join(errors, "; "))
+	}
+
+	return nil
+}
+
+func (q *QueryParser) checkFunction(name string, experimental bool) error {
+	if slices.Contains(q.options.DisabledFunctions, name) {
+		return fmt.Errorf("function %q is disabled on this proxy", name)
+	}
+	if experimental && !q.options.ExperimentalFunctions && !slices.Contains(q.options.EnabledFunctions, name) {
+		return fmt.Errorf("experimental function %q is not enabled on this proxy", name)
+	}
+	return nil
+}
+
+func (q *QueryParser) checkDurationExpr(query string, node parser.Node) string {
+	if q.options.DurationExpressions {
+		return ""
+	}
+	return positioned(query, node, fmt.Errorf("duration expressions are not enabled on this proxy"))
+}
+
+// positioned 在错误信息前加上节点在查询中的位置
+func positioned(query string, node parser.Node, err error) string {
+	pos := node.PositionRange()
+	if pos.Start < 0 || int(pos.End) > len(query) || pos.Start > pos.End {
+		return err.Error()
+	}
+	return fmt.Sprintf("%s (at %d:%d in %q)", err, pos.Start, pos.End, query[pos.Start:pos.End])
+}
+
+// isAggregator 判断 name 是否为 sum、topk、limitk 等聚合操作符，聚合操作符不在 parser.Functions 中
+func isAggregator(name string) bool {
+	for typ, str := range parser.ItemTypeStr {
+		if typ.IsAggregator() && str == name {
+			return true
+		}
+	}
+	return false
+}
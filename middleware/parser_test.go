@@ -0,0 +1,40 @@
+package middleware
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNewQueryParser(t *testing.T) {
+	tests := []struct {
+		names []string
+		valid bool
+	}{
+		{[]string{"rate", "histogram_quantile"}, true},
+		{[]string{"topk", "quantile", "count_values"}, true},
+		{[]string{"limitk", "limit_ratio"}, true},
+		{[]string{"no_such_function"}, false},
+		{[]string{"and"}, false},
+	}
+
+	for _, tt := range tests {
+		_, err := NewQueryParser(ParserOptions{DisabledFunctions: tt.names})
+		if (err == nil) != tt.valid {
+			t.Errorf("disabled functions %v: got error %v, want valid %v", tt.names, err, tt.valid)
+		}
+	}
+}
+
+func TestDisabledAggregator(t *testing.T) {
+	p, err := NewQueryParser(ParserOptions{DisabledFunctions: []string{"topk"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := p.ParseExpr(`topk(5, up{space="production"})`); err == nil || !strings.Contains(err.Error(), `function "topk" is disabled`) {
+		t.Errorf("got %v, want topk to be disabled", err)
+	}
+	if _, err := p.ParseExpr(`bottomk(5, up{space="production"})`); err != nil {
+		t.Errorf("got %v, want bottomk to be allowed", err)
+	}
+}
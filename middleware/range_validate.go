@@ -5,6 +5,8 @@ import (
 	"time"
 )
 
+const rangeValidateName = "range_validate"
+
 type QueryRangeMiddleware struct{}
 
 func NewQueryRangeMiddleware() *QueryRangeMiddleware {
@@ -16,13 +18,33 @@ func (q *QueryRangeMiddleware) Process(ctx *RequestContext) error {
 }
 
 func (q *QueryRangeMiddleware) validateQueryRange(ctx *RequestContext) error {
-	if !ctx.IsRange || ctx.Step == "" {
+	if !ctx.IsRange {
+		return nil
+	}
+
+	if ctx.StartTime != nil && ctx.EndTime != nil && ctx.EndTime.Before(*ctx.StartTime) {
+		return Violations{{
+			Middleware: rangeValidateName,
+			Rule:       "invalid_range",
+			Kind:       KindInvalid,
+			Message:    "end timestamp must not be before start time",
+			Suggestion: "swap the start and end parameters",
+		}}
+	}
+
+	if ctx.Step == "" {
 		return nil
 	}
 
 	stepDuration, err := time.ParseDuration(ctx.Step)
 	if err != nil {
-		return fmt.Errorf("invalid step format: %v", err)
+		return Violations{{
+			Middleware: rangeValidateName,
+			Rule:       "invalid_step",
+			Kind:       KindInvalid,
+			Message:    fmt.Sprintf("invalid step format: %v", err),
+			Suggestion: "specify the step as a duration, for example 1m",
+		}}
 	}
 
 	var queryDuration time.Duration
@@ -42,12 +64,24 @@ func (q *QueryRangeMiddleware) validateQueryRange(ctx *RequestContext) error {
 	case stepDuration >= 1*time.Minute:
 		maxDuration = 6 * time.Hour
 	default:
-		return fmt.Errorf("step must be at least 1 minute")
+		return Violations{{
+			Middleware: rangeValidateName,
+			Rule:       "step_too_small",
+			Kind:       KindLimit,
+			Message:    "step must be at least 1 minute",
+			Suggestion: "increase the step to 1m or more",
+		}}
 	}
 
 	if queryDuration > maxDuration {
-		return fmt.Errorf("query range %v exceeds maximum allowed %v for step %v",
-			queryDuration, maxDuration, stepDuration)
+		return Violations{{
+			Middleware: rangeValidateName,
+			Rule:       "query_range_too_long",
+			Kind:       KindLimit,
+			Message: fmt.Sprintf("query range %v exceeds maximum allowed %v for step %v",
+				queryDuration, maxDuration, stepDuration),
+			Suggestion: fmt.Sprintf("shorten the time range to %v or increase the step", maxDuration),
+		}}
 	}
 
 	return nil
@@ -0,0 +1,121 @@
+package middleware
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// SeriesCounter 返回选择器在时间窗口内匹配的序列数，limit > 0 时允许在超过 limit 后提前截断
+type SeriesCounter interface {
+	CountSeries(ctx context.Context, selector string, start, end time.Time, limit int) (int, error)
+}
+
+type PrometheusSeriesCounter struct {
+	URL    string
+	Client *http.Client
+}
+
+func NewPrometheusSeriesCounter(url string, client *http.Client) *PrometheusSeriesCounter {
+	return &PrometheusSeriesCounter{
+		URL:    url,
+		Client: client,
+	}
+}
+
+func (p *PrometheusSeriesCounter) CountSeries(ctx context.Context, selector string, start, end time.Time, limit int) (int, error) {
+	params := url.Values{}
+	params.Set("match[]", selector)
+	params.Set("start", strconv.FormatInt(start.Unix(), 10))
+	params.Set("end", strconv.FormatInt(end.Unix(), 10))
+	if limit > 0 {
+		params.Set("limit", strconv.Itoa(limit))
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL+"/api/v1/series?"+params.Encode(), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		Status string            `json:"status"`
+		Error  string            `json:"error"`
+		Data   []json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return 0, fmt.Errorf("decode series response: %v", err)
+	}
+	if result.Status != "success" {
+		return 0, fmt.Errorf("series request failed: %s", result.Error)
+	}
+
+	return len(result.Data), nil
+}
+
+type seriesCacheEntry struct {
+	count     int
+	truncated bool
+	expires   time.Time
+}
+
+// CachedSeriesCounter 按选择器和对齐后的时间窗口缓存序列数
+type CachedSeriesCounter struct {
+	counter SeriesCounter
+	ttl     time.Duration
+
+	mu      sync.Mutex
+	entries map[string]seriesCacheEntry
+}
+
+func NewCachedSeriesCounter(counter SeriesCounter, ttl time.Duration) *CachedSeriesCounter {
+	return &CachedSeriesCounter{
+		counter: counter,
+		ttl:     ttl,
+		entries: make(map[string]seriesCacheEntry),
+	}
+}
+
+func (c *CachedSeriesCounter) CountSeries(ctx context.Context, selector string, start, end time.Time, limit int) (int, error) {
+	key := fmt.Sprintf("%s|%d|%d", selector, start.Truncate(c.ttl).Unix(), end.Truncate(c.ttl).Unix())
+	now := time.Now()
+
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	c.mu.Unlock()
+
+	// 被截断的结果只对不超过截断值的 limit 有效
+	if ok && now.Before(entry.expires) && (!entry.truncated || (limit > 0 && entry.count >= limit)) {
+		return entry.count, nil
+	}
+
+	count, err := c.counter.CountSeries(ctx, selector, start, end, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	c.mu.Lock()
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = seriesCacheEntry{
+		count:     count,
+		truncated: limit > 0 && count >= limit,
+		expires:   now.Add(c.ttl),
+	}
+	c.mu.Unlock()
+
+	return count, nil
+}
@@ -0,0 +1,47 @@
+package middleware
+
+import (
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+const spaceLabel = "space"
+
+// ExprSpaces 返回查询中所有选择器引用的 space 值
+func ExprSpaces(expr parser.Expr) []string {
+	var spaces []string
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		if vs, ok := node.(*parser.VectorSelector); ok {
+			spaces = append(spaces, MatcherSpaces(vs.LabelMatchers)...)
+		}
+		return nil
+	})
+
+	slices.Sort(spaces)
+	return slices.Compact(spaces)
+}
+
+// MatcherSpaces 返回匹配器中能确定的 space 值，只识别等值匹配和由字面量组成的正则分支
+func MatcherSpaces(matchers []*labels.Matcher) []string {
+	var spaces []string
+	for _, m := range matchers {
+		if m.Name != spaceLabel {
+			continue
+		}
+		switch m.Type {
+		case labels.MatchEqual:
+			spaces = append(spaces, m.Value)
+		case labels.MatchRegexp:
+			for _, value := range strings.Split(m.Value, "|") {
+				if value == regexp.QuoteMeta(value) {
+					spaces = append(spaces, value)
+				}
+			}
+		}
+	}
+	return spaces
+}
@@ -1,10 +1,11 @@
 package middleware
 
 import (
-	"fmt"
 	"time"
 )
 
+const timeValidateName = "time_validate"
+
 type TimeValidateMiddleware struct{}
 
 func NewTimeValidateMiddleware() *TimeValidateMiddleware {
@@ -16,12 +17,18 @@ func (t *TimeValidateMiddleware) Process(ctx *RequestContext) error {
 }
 
 func (t *TimeValidateMiddleware) validateTimeRange(ctx *RequestContext) error {
-	now := time.Now()
+	now := ctx.now()
 	twoHoursAgo := now.Add(-2 * time.Hour)
 
 	if ctx.Timestamp != nil {
 		if ctx.Timestamp.Before(twoHoursAgo) {
-			return fmt.Errorf("timestamp must be within 2 hours from now")
+			return Violations{{
+				Middleware: timeValidateName,
+				Rule:       "timestamp_too_old",
+				Kind:       KindLimit,
+				Message:    "timestamp must be within 2 hours from now",
+				Suggestion: "use a range query to look further back",
+			}}
 		}
 	}
 
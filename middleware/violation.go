@@ -0,0 +1,104 @@
+package middleware
+
+import (
+	"strings"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// Position 为违规节点在查询字符串中的字节偏移范围 [Start, End)
+type Position struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
+}
+
+// Violation 描述查询违反的一条规则
+type Violation struct {
+	Middleware string    `json:"middleware"`
+	Rule       string    `json:"rule"`
+	Kind       ErrorKind `json:"-"`
+	Node       string    `json:"node,omitempty"`
+	Position   *Position `json:"position,omitempty"`
+	Message    string    `json:"message"`
+	Suggestion string    `json:"suggestion,omitempty"`
+}
+
+// Violations 为一次校验发现的全部违规
+type Violations []Violation
+
+func (v Violations) Error() string {
+	messages := make([]string, len(v))
+	for i, violation := range v {
+		messages[i] = violation.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Kind 返回决定响应状态码的类别，优先级为 KindInvalid、KindDenied、KindLimit
+func (v Violations) Kind() ErrorKind {
+	kind := KindLimit
+	for _, violation := range v {
+		switch violation.Kind {
+		case KindInvalid:
+			return KindInvalid
+		case KindDenied:
+			kind = KindDenied
+		}
+	}
+	return kind
+}
+
+// at 记录违规的 AST 节点及其在查询中的位置
+func (v Violation) at(ctx *RequestContext, node parser.Node) Violation {
+	pos := node.PositionRange()
+	start, end := int(pos.Start), int(pos.End)
+	if start >= 0 && start < end && end <= len(ctx.Query) {
+		v.Node = ctx.Query[start:end]
+		v.Position = &Position{Start: start, End: end}
+	} else {
+		v.Node = node.String()
+	}
+	return v
+}
+
+// backendMiddleware 由需要查询后端的中间件实现
+type backendMiddleware interface {
+	queriesBackend()
+}
+
+// Offline 返回不需要查询后端的中间件
+func Offline(middlewares []Middleware) []Middleware {
+	var offline []Middleware
+	for _, m := range middlewares {
+		if _, ok := m.(backendMiddleware); !ok {
+			offline = append(offline, m)
+		}
+	}
+	return offline
+}
+
+// Process 依次执行中间件并收集所有违规。已有违规时跳过需要查询后端的中间件，
+// 避免为注定被拒绝的查询（例如访问未授权的 space）访问后端；中间件返回违规以外的错误时立即返回
+func Process(middlewares []Middleware, ctx *RequestContext) error {
+	var violations Violations
+	for _, m := range middlewares {
+		if _, ok := m.(backendMiddleware); ok && len(violations) > 0 {
+			continue
+		}
+
+		err := m.Process(ctx)
+		if err == nil {
+			continue
+		}
+		vs, ok := err.(Violations)
+		if !ok {
+			return err
+		}
+		violations = append(violations, vs...)
+	}
+
+	if len(violations) > 0 {
+		return violations
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/zhengtianbao/promproxy/config"
+	"github.com/zhengtianbao/promproxy/middleware"
+)
+
+// 审计记录的决定
+const (
+	decisionAllowed  = "allowed"
+	decisionDenied   = "denied"
+	decisionRejected = "rejected"
+	// 请求已放行，但响应在写回客户端的过程中被中断
+	decisionAborted = "aborted"
+)
+
+// AuditRecord 为审计日志中的一行
+type AuditRecord struct {
+	Time          time.Time              `json:"time"`
+	RequestID     string                 `json:"request_id"`
+	User          string                 `json:"user,omitempty"`
+	ClientIP      string                 `json:"client_ip"`
+	Tenant        string                 `json:"tenant"`
+	Method        string                 `json:"method"`
+	Path          string                 `json:"path"`
+	Query         string                 `json:"query,omitempty"`
+	Match         []string               `json:"match,omitempty"`
+	Spaces        []string               `json:"spaces,omitempty"`
+	Start         string                 `json:"start,omitempty"`
+	End           string                 `json:"end,omitempty"`
+	EvalTime      string                 `json:"eval_time,omitempty"`
+	Step          string                 `json:"step,omitempty"`
+	Decision      string                 `json:"decision"`
+	Violations    []middleware.Violation `json:"violations,omitempty"`
+	Status        int                    `json:"status"`
+	Backend       string                 `json:"backend,omitempty"`
+	BackendStatus int                    `json:"backend_status,omitempty"`
+}
+
+// auditLog 把审计记录逐行写入 JSONL 文件
+type auditLog struct {
+	sampleRatio    float64
+	identityHeader string
+	clientIPHeader string
+
+	mu  sync.Mutex
+	out io.WriteCloser
+	enc *json.Encoder
+}
+
+func newAuditLog(cfg config.AuditConfig, clientIPHeader string) *auditLog {
+	out := newLogFile(cfg.File)
+	return &auditLog{
+		sampleRatio:    cfg.AllowedSampleRatio,
+		identityHeader: cfg.IdentityHeader,
+		clientIPHeader: clientIPHeader,
+		out:            out,
+		enc:            json.NewEncoder(out),
+	}
+}
+
+// record 记录请求的审计信息，放行的请求按比例采样
+func (a *auditLog) record(r *http.Request, tenant string, info *requestInfo, sw *statusWriter, params map[string][]string, aborted bool) {
+	status := sw.statusCode()
+	backendStatus := int(info.backendStatus.Load())
+
+	decision := decisionAllowed
+	switch {
+	case len(info.violations) > 0:
+		decision = decisionDenied
+	case aborted:
+		decision = decisionAborted
+	case backendStatus == 0 && status >= http.StatusBadRequest:
+		// 请求没有到达后端，例如参数错误、限速或排队超时
+		decision = decisionRejected
+	}
+	if decision == decisionAllowed && rand.Float64() >= a.sampleRatio {
+		return
+	}
+
+	get := func(key string) string {
+		if values := params[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	record := &AuditRecord{
+		Time:          time.Now(),
+		RequestID:     info.id,
+		User:          a.user(r),
+		ClientIP:      clientIP(r, a.clientIPHeader),
+		Tenant:        tenant,
+		Method:        r.Method,
+		Path:          r.URL.Path,
+		Query:         get("query"),
+		Match:         params["match[]"],
+		Spaces:        info.spaces,
+		Start:         get("start"),
+		End:           get("end"),
+		EvalTime:      get("time"),
+		Step:          get("step"),
+		Decision:      decision,
+		Violations:    info.violations,
+		Status:        status,
+		Backend:       sw.Header().Get(backendHeader),
+		BackendStatus: backendStatus,
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if err := a.enc.Encode(record); err != nil {
+		slog.Error("Error writing audit log", "request_id", info.id, "err", err)
+	}
+}
+
+// user 返回认证代理传入的用户名，没有时使用 basic auth 的用户名
+func (a *auditLog) user(r *http.Request) string {
+	if a.identityHeader != "" {
+		if user := r.Header.Get(a.identityHeader); user != "" {
+			return user
+		}
+	}
+	user, _, _ := r.BasicAuth()
+	return user
+}
+
+func (a *auditLog) close() error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.out.Close()
+}
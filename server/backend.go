@@ -0,0 +1,262 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhengtianbao/promproxy/config"
+	"github.com/zhengtianbao/promproxy/middleware"
+)
+
+const backendHeader = "X-Promproxy-Backend"
+
+const (
+	strategyRoundRobin     = "round_robin"
+	strategyLeastInflight  = "least_inflight"
+	strategyPrimaryStandby = "primary_standby"
+)
+
+var errNoHealthyBackend = errors.New("no healthy Prometheus backend available")
+
+type backendContextKey struct{}
+
+type backend struct {
+	url     *url.URL
+	pool    *backendPool
+	breaker *circuitBreaker
+
+	healthy      atomic.Bool
+	inflight     atomic.Int64
+	failures     atomic.Int64
+	ejectedUntil atomic.Int64
+}
+
+// available 返回后端是否通过主动检查且未被被动摘除
+func (b *backend) available(now time.Time) bool {
+	return b.healthy.Load() && now.UnixNano() >= b.ejectedUntil.Load()
+}
+
+type backendPool struct {
+	backends    []*backend
+	strategy    string
+	healthCheck config.HealthCheckConfig
+	passive     config.PassiveHealthConfig
+	transport   http.RoundTripper
+	next        atomic.Uint64
+}
+
+func newBackendPool(cfg config.PrometheusConfig, transport http.RoundTripper) (*backendPool, error) {
+	pool := &backendPool{
+		strategy:    cfg.Strategy,
+		healthCheck: cfg.HealthCheck,
+		passive:     cfg.PassiveHealth,
+		transport:   transport,
+	}
+
+	switch pool.strategy {
+	case "":
+		pool.strategy = strategyRoundRobin
+	case strategyRoundRobin, strategyLeastInflight, strategyPrimaryStandby:
+	default:
+		return nil, fmt.Errorf("unknown backend strategy %q", cfg.Strategy)
+	}
+
+	for _, endpoint := range cfg.BackendURLs() {
+		u, err := url.Parse(endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid prometheus url %q: %v", endpoint, err)
+		}
+		b := &backend{url: u, pool: pool, breaker: newCircuitBreaker(u.Host, cfg.Breaker)}
+		b.healthy.Store(true)
+		pool.backends = append(pool.backends, b)
+	}
+	if len(pool.backends) == 0 {
+		return nil, fmt.Errorf("no prometheus backend configured")
+	}
+
+	return pool, nil
+}
+
+// pick 按负载均衡策略选择一个可用且未熔断的后端
+func (p *backendPool) pick() (*backend, error) {
+	now := time.Now()
+	for _, b := range p.candidates(now) {
+		if b.breaker.allow(now) {
+			return b, nil
+		}
+	}
+	return nil, errNoHealthyBackend
+}
+
+// candidates 按负载均衡策略的优先顺序返回可用的后端；没有可用的后端时进入 panic 模式返回全部后端，
+// 避免健康检查误判或被动摘除使所有请求失败
+func (p *backendPool) candidates(now time.Time) []*backend {
+	if available := p.ordered(func(b *backend) bool { return b.available(now) }); len(available) > 0 {
+		return available
+	}
+	return p.ordered(func(*backend) bool { return true })
+}
+
+// ordered 按负载均衡策略的优先顺序返回满足 include 的后端
+func (p *backendPool) ordered(include func(*backend) bool) []*backend {
+	var available []*backend
+
+	switch p.strategy {
+	case strategyPrimaryStandby:
+		for _, b := range p.backends {
+			if include(b) {
+				available = append(available, b)
+			}
+		}
+	case strategyLeastInflight:
+		for _, b := range p.backends {
+			if include(b) {
+				available = append(available, b)
+			}
+		}
+		slices.SortStableFunc(available, func(a, b *backend) int {
+			return cmp.Compare(a.inflight.Load(), b.inflight.Load())
+		})
+	default:
+		n := uint64(len(p.backends))
+		start := p.next.Add(1)
+		for i := uint64(0); i < n; i++ {
+			if b := p.backends[(start+i)%n]; include(b) {
+				available = append(available, b)
+			}
+		}
+	}
+
+	return available
+}
+
+// observe 记录一次请求结果，连续失败达到阈值后暂时摘除后端
+func (p *backendPool) observe(b *backend, failed bool) {
+	b.breaker.record(failed, time.Now())
+	if !failed {
+		b.failures.Store(0)
+		return
+	}
+
+	maxFailures := int64(p.passive.MaxFailures)
+	if maxFailures <= 0 {
+		return
+	}
+	if b.failures.Add(1) >= maxFailures {
+		b.failures.Store(0)
+		b.ejectedUntil.Store(time.Now().Add(p.passive.EjectionTime).UnixNano())
+		slog.Warn("Backend ejected after consecutive failures", "backend", b.url.String(), "ejection_time", p.passive.EjectionTime.String(), "failures", maxFailures)
+	}
+}
+
+// runHealthChecks 周期性探测所有后端，直到 ctx 结束
+func (p *backendPool) runHealthChecks(ctx context.Context) {
+	if p.healthCheck.Interval <= 0 {
+		return
+	}
+
+	client := &http.Client{Transport: p.transport, Timeout: p.healthCheck.Timeout}
+	ticker := time.NewTicker(p.healthCheck.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, b := range p.backends {
+			healthy := p.check(ctx, client, b)
+			if b.healthy.Swap(healthy) != healthy {
+				slog.Warn("Backend health changed", "backend", b.url.String(), "healthy", healthy)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *backendPool) check(ctx context.Context, client *http.Client, b *backend) bool {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, b.url.JoinPath(p.healthCheck.Path).String(), nil)
+	if err != nil {
+		return false
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+
+	return resp.StatusCode == http.StatusOK
+}
+
+// isBackendFailure 判断后端响应是否应计入被动健康检查的失败并重试。
+// Prometheus 查询超时同样返回 503，errorType 为 timeout，说明查询本身代价过高而不是后端故障，
+// 换一个后端重试只会再执行一遍同样的查询
+func isBackendFailure(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusGatewayTimeout:
+		return true
+	case http.StatusServiceUnavailable:
+		return backendErrorType(resp) != errorTimeout
+	}
+	return false
+}
+
+// backendErrorType 返回错误响应中的 errorType，无法解析时返回空字符串；读取的内容会放回响应体
+func backendErrorType(resp *http.Response) string {
+	head, err := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), resp.Body), resp.Body}
+	if err != nil {
+		return ""
+	}
+
+	var body io.Reader = bytes.NewReader(head)
+	if strings.EqualFold(resp.Header.Get("Content-Encoding"), "gzip") {
+		if body, err = gzip.NewReader(body); err != nil {
+			return ""
+		}
+	}
+	var apiResp apiResponse
+	if err := json.NewDecoder(body).Decode(&apiResp); err != nil {
+		return ""
+	}
+	return apiResp.ErrorType
+}
+
+// poolSeriesCounter 按选择器中的 space 选择后端查询序列数
+type poolSeriesCounter struct {
+	router *router
+	client *http.Client
+}
+
+func (c *poolSeriesCounter) CountSeries(ctx context.Context, selector string, start, end time.Time, limit int) (int, error) {
+	pool, err := c.router.poolFor(selectorSpaces(selector))
+	if err != nil {
+		return 0, err
+	}
+	b, err := pool.pick()
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := middleware.NewPrometheusSeriesCounter(b.url.String(), c.client).CountSeries(ctx, selector, start, end, limit)
+	pool.observe(b, err != nil)
+	return count, err
+}
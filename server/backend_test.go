@@ -0,0 +1,60 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestIsBackendFailure(t *testing.T) {
+	gzipped := func(s string) string {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		zw.Write([]byte(s))
+		zw.Close()
+		return buf.String()
+	}
+	const timeoutBody = `{"status":"error","errorType":"timeout","error":"query timed out in expression evaluation"}`
+
+	tests := []struct {
+		name     string
+		status   int
+		encoding string
+		body     string
+		want     bool
+	}{
+		{"ok", http.StatusOK, "", `{"status":"success"}`, false},
+		{"bad data", http.StatusBadRequest, "", `{"status":"error","errorType":"bad_data"}`, false},
+		{"execution error", http.StatusUnprocessableEntity, "", `{"status":"error","errorType":"execution"}`, false},
+		{"bad gateway", http.StatusBadGateway, "", "", true},
+		{"gateway timeout", http.StatusGatewayTimeout, "", "", true},
+		{"query timeout", http.StatusServiceUnavailable, "", timeoutBody, false},
+		{"gzipped query timeout", http.StatusServiceUnavailable, "gzip", gzipped(timeoutBody), false},
+		{"unavailable", http.StatusServiceUnavailable, "", `{"status":"error","errorType":"unavailable"}`, true},
+		{"not json", http.StatusServiceUnavailable, "", "Service Unavailable", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{StatusCode: tt.status, Header: http.Header{}, Body: io.NopCloser(strings.NewReader(tt.body))}
+			if tt.encoding != "" {
+				resp.Header.Set("Content-Encoding", tt.encoding)
+			}
+			if got := isBackendFailure(resp); got != tt.want {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+
+			// 判断时读取的响应体需要原样转发给客户端
+			body, err := io.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.body {
+				t.Errorf("got body %q, want %q", body, tt.body)
+			}
+		})
+	}
+}
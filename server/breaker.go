@@ -0,0 +1,121 @@
+package server
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/zhengtianbao/promproxy/config"
+)
+
+const (
+	breakerClosed = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+// circuitBreaker 在后端连续失败后快速失败，熔断 open_duration 后进入半开状态，
+// 半开状态只放行少量探测请求，探测全部成功后恢复，任一失败则重新熔断
+type circuitBreaker struct {
+	name   string
+	config config.BreakerConfig
+
+	mu        sync.Mutex
+	state     int
+	failures  int
+	successes int
+	probes    int
+	changedAt time.Time
+}
+
+func newCircuitBreaker(name string, cfg config.BreakerConfig) *circuitBreaker {
+	if !cfg.Enabled {
+		return nil
+	}
+	return &circuitBreaker{name: name, config: cfg}
+}
+
+// allow 判断是否可以向后端发送请求，半开状态下每次放行都会占用一个探测名额
+func (c *circuitBreaker) allow(now time.Time) bool {
+	if c == nil {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case breakerOpen:
+		if now.Sub(c.changedAt) < c.config.OpenDuration {
+			return false
+		}
+		c.transition(breakerHalfOpen, now)
+	case breakerHalfOpen:
+		// 探测请求长时间没有结果（例如被客户端取消）时重新开始探测
+		if c.probes >= c.config.HalfOpenRequests && now.Sub(c.changedAt) >= c.config.OpenDuration {
+			c.transition(breakerHalfOpen, now)
+		}
+	}
+
+	if c.state == breakerHalfOpen {
+		if c.probes >= c.config.HalfOpenRequests {
+			return false
+		}
+		c.probes++
+	}
+	return true
+}
+
+// record 记录一次请求结果
+func (c *circuitBreaker) record(failed bool, now time.Time) {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	switch c.state {
+	case breakerClosed:
+		if !failed {
+			c.failures = 0
+			return
+		}
+		c.failures++
+		if c.failures >= c.config.FailureThreshold {
+			c.transition(breakerOpen, now)
+		}
+	case breakerHalfOpen:
+		if failed {
+			c.transition(breakerOpen, now)
+			return
+		}
+		c.successes++
+		if c.successes >= c.config.HalfOpenRequests {
+			c.transition(breakerClosed, now)
+		}
+	}
+}
+
+func (c *circuitBreaker) transition(state int, now time.Time) {
+	if c.state != state {
+		slog.Warn("Circuit breaker state changed", "backend", c.name, "from", breakerStateName(c.state), "to", breakerStateName(state))
+	}
+	c.state = state
+	c.failures = 0
+	c.successes = 0
+	c.probes = 0
+	c.changedAt = now
+	backendCircuitState.WithLabelValues(c.name).Set(float64(state))
+}
+
+func breakerStateName(state int) string {
+	switch state {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
@@ -0,0 +1,366 @@
+package server
+
+import (
+	"cmp"
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/zhengtianbao/promproxy/config"
+)
+
+const cacheHeader = "X-Promproxy-Cache"
+
+// cacheExtent 为一段已缓存的连续结果，start 与 end 为按 step 对齐的毫秒时间戳
+type cacheExtent struct {
+	start int64
+	end   int64
+	data  *queryData
+}
+
+type cacheEntry struct {
+	key     string
+	extents []*cacheExtent
+	size    int64
+}
+
+// resultsCache 为按 LRU 淘汰的范围查询结果缓存
+type resultsCache struct {
+	maxEntries   int
+	maxBytes     int64
+	maxFreshness time.Duration
+
+	mu    sync.Mutex
+	size  int64
+	lru   *list.List
+	items map[string]*list.Element
+}
+
+func newResultsCache(cfg config.ResultsCacheConfig) *resultsCache {
+	return &resultsCache{
+		maxEntries:   cfg.MaxEntries,
+		maxBytes:     cfg.MaxSizeBytes,
+		maxFreshness: cfg.MaxFreshness,
+		lru:          list.New(),
+		items:        make(map[string]*list.Element),
+	}
+}
+
+func (c *resultsCache) get(key string) []*cacheExtent {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.items[key]
+	if !ok {
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	return slices.Clone(elem.Value.(*cacheEntry).extents)
+}
+
+func (c *resultsCache) put(key string, extents []*cacheExtent) {
+	entry := &cacheEntry{key: key, extents: extents}
+	for _, e := range extents {
+		entry.size += int64(len(e.data.Result))
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.items[key]; ok {
+		c.size -= elem.Value.(*cacheEntry).size
+		c.lru.Remove(elem)
+	}
+	c.items[key] = c.lru.PushFront(entry)
+	c.size += entry.size
+
+	for c.lru.Len() > 0 && ((c.maxEntries > 0 && c.lru.Len() > c.maxEntries) || (c.maxBytes > 0 && c.size > c.maxBytes)) {
+		oldest := c.lru.Back()
+		evicted := oldest.Value.(*cacheEntry)
+		c.lru.Remove(oldest)
+		delete(c.items, evicted.key)
+		c.size -= evicted.size
+		resultsCacheEvictions.Inc()
+	}
+
+	resultsCacheEntries.Set(float64(c.lru.Len()))
+	resultsCacheBytes.Set(float64(c.size))
+}
+
+// rangeParams 为对齐后的范围查询参数，时间均为毫秒
+type rangeParams struct {
+	params url.Values
+	expr   parser.Expr
+	start  int64
+	end    int64
+	step   int64
+}
+
+// parseRangeParams 解析范围查询参数，无法安全地按子区间执行时返回 false
+func (p *ProxyServer) parseRangeParams(params url.Values) (*rangeParams, bool) {
+	start, err := parseTimeMillis(params.Get("start"))
+	if err != nil {
+		return nil, false
+	}
+	end, err := parseTimeMillis(params.Get("end"))
+	if err != nil {
+		return nil, false
+	}
+	step, err := parseDurationParam(params.Get("step"))
+	if err != nil || step < time.Millisecond || end < start {
+		return nil, false
+	}
+
+	expr, err := p.current().QueryParser.ParseExpr(params.Get("query"))
+	if err != nil || hasAtModifier(expr) {
+		return nil, false
+	}
+
+	return &rangeParams{
+		params: params,
+		expr:   expr,
+		start:  start,
+		end:    end,
+		step:   step.Milliseconds(),
+	}, true
+}
+
+// withRange 返回替换了 start 与 end 的查询参数
+func (rp *rangeParams) withRange(start, end int64) url.Values {
+	params := url.Values{}
+	for key, values := range rp.params {
+		params[key] = values
+	}
+	params.Set("start", formatTimeMillis(start))
+	params.Set("end", formatTimeMillis(end))
+	return params
+}
+
+// serveCachedRange 使用结果缓存处理范围查询，只向后端查询缺失的子区间；不适合缓存时返回 false
+func (p *ProxyServer) serveCachedRange(w http.ResponseWriter, r *http.Request, pools []*backendPool, limits config.LimitsConfig) bool {
+	params, err := readForm(r)
+	if err != nil {
+		return false
+	}
+	rp, ok := p.parseRangeParams(params)
+	if !ok || rp.start%rp.step != 0 {
+		return false
+	}
+
+	// 最近一段时间的数据仍在变化，不写入缓存
+	cutoff := time.Now().Add(-p.cache.maxFreshness).UnixMilli()
+	cachedEnd := min(alignDown(rp.end, rp.start, rp.step), alignDown(cutoff, rp.start, rp.step))
+	if cachedEnd < rp.start {
+		return false
+	}
+
+	key := fmt.Sprintf("%s|%d|%s", p.tenant(r), rp.step, rp.expr.String())
+	extents := p.cache.get(key)
+
+	var backends, warnings []string
+	fetch := func(start, end int64) (*queryData, bool) {
+		resp, used, err := p.executeRange(r, pools, rp, start, end, limits)
+		backends = append(backends, used...)
+		if err != nil {
+			w.Header().Set(backendHeader, strings.Join(backends, ","))
+			writeBackendError(w, err)
+			return nil, false
+		}
+		warnings = uniqueStrings(warnings, resp.Warnings)
+		return resp.Data, true
+	}
+
+	missing := missingRanges(extents, rp.start, cachedEnd, rp.step)
+	fetched := make([]*cacheExtent, 0, len(missing))
+	for _, m := range missing {
+		data, ok := fetch(m[0], m[1])
+		if !ok {
+			return true
+		}
+		fetched = append(fetched, &cacheExtent{start: m[0], end: m[1], data: data})
+	}
+
+	switch {
+	case len(missing) == 0:
+		resultsCacheRequests.WithLabelValues("hit").Inc()
+		w.Header().Set(cacheHeader, "hit")
+	case len(extents) == 0:
+		resultsCacheRequests.WithLabelValues("miss").Inc()
+		w.Header().Set(cacheHeader, "miss")
+	default:
+		resultsCacheRequests.WithLabelValues("partial").Inc()
+		w.Header().Set(cacheHeader, "partial")
+	}
+
+	extents, err = mergeExtents(append(extents, fetched...), rp.step)
+	if err != nil {
+		writeBackendError(w, err)
+		return true
+	}
+	// 带 warning 的结果可能不完整，不写入缓存
+	if len(fetched) > 0 && len(warnings) == 0 {
+		p.cache.put(key, extents)
+	}
+
+	datas := make([]*queryData, 0, len(extents)+1)
+	for _, e := range extents {
+		if e.end < rp.start || e.start > cachedEnd {
+			continue
+		}
+		data, err := extractRange(e.data, rp.start, cachedEnd)
+		if err != nil {
+			writeBackendError(w, err)
+			return true
+		}
+		datas = append(datas, data)
+	}
+	if cachedEnd+rp.step <= rp.end {
+		data, ok := fetch(cachedEnd+rp.step, rp.end)
+		if !ok {
+			return true
+		}
+		datas = append(datas, data)
+	}
+	if len(backends) == 0 {
+		backends = []string{"cache"}
+	}
+	w.Header().Set(backendHeader, strings.Join(backends, ","))
+
+	data, err := mergeQueryData(datas)
+	if err == nil {
+		err = checkMergedLimits(data, limits)
+	}
+	if err != nil {
+		writeBackendError(w, err)
+		return true
+	}
+
+	writeAPIResponse(w, &apiResponse{
+		Status:   "success",
+		Data:     data,
+		Warnings: warnings,
+	})
+	return true
+}
+
+// missingRanges 返回 [start, end] 中未被缓存覆盖的子区间
+func missingRanges(extents []*cacheExtent, start, end, step int64) [][2]int64 {
+	var missing [][2]int64
+	cursor := start
+	for _, e := range extents {
+		if e.end < cursor || e.start > end {
+			continue
+		}
+		if e.start > cursor {
+			missing = append(missing, [2]int64{cursor, alignDown(e.start-1, start, step)})
+		}
+		cursor = max(cursor, alignDown(e.end, start, step)+step)
+	}
+	if cursor <= end {
+		missing = append(missing, [2]int64{cursor, end})
+	}
+
+	return slices.DeleteFunc(missing, func(m [2]int64) bool { return m[1] < m[0] })
+}
+
+// mergeExtents 合并重叠或相邻的缓存区间
+func mergeExtents(extents []*cacheExtent, step int64) ([]*cacheExtent, error) {
+	slices.SortFunc(extents, func(a, b *cacheExtent) int {
+		return cmp.Compare(a.start, b.start)
+	})
+
+	var merged []*cacheExtent
+	for _, e := range extents {
+		if n := len(merged); n > 0 && e.start <= merged[n-1].end+step {
+			last := merged[n-1]
+			data, err := mergeQueryData([]*queryData{last.data, e.data})
+			if err != nil {
+				return nil, err
+			}
+			merged[n-1] = &cacheExtent{start: last.start, end: max(last.end, e.end), data: data}
+			continue
+		}
+		merged = append(merged, e)
+	}
+	return merged, nil
+}
+
+// extractRange 返回 matrix 结果中时间戳位于 [start, end] 内的样本
+func extractRange(data *queryData, start, end int64) (*queryData, error) {
+	var streams []*sampleStream
+	if err := json.Unmarshal(data.Result, &streams); err != nil {
+		return nil, fmt.Errorf("decode %s result: %v", data.ResultType, err)
+	}
+
+	outOfRange := func(raw json.RawMessage) bool {
+		ts, err := pointTimestamp(raw)
+		if err != nil {
+			return false
+		}
+		ms := int64(math.Round(ts * 1000))
+		return ms < start || ms > end
+	}
+
+	extracted := streams[:0]
+	for _, s := range streams {
+		s.Values = slices.DeleteFunc(s.Values, outOfRange)
+		s.Histograms = slices.DeleteFunc(s.Histograms, outOfRange)
+		if len(s.Values) > 0 || len(s.Histograms) > 0 {
+			extracted = append(extracted, s)
+		}
+	}
+
+	result, err := json.Marshal(extracted)
+	if err != nil {
+		return nil, err
+	}
+	return &queryData{ResultType: data.ResultType, Result: result}, nil
+}
+
+// hasAtModifier 判断查询是否使用了 @ 修饰符。@ start() 与 @ end() 的取值依赖于整个查询区间，
+// 固定时间戳的 @ 虽不依赖区间，但会让每个子区间重复读取同一段数据，同样不做拆分和缓存
+func hasAtModifier(expr parser.Expr) bool {
+	found := false
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.VectorSelector:
+			found = found || n.Timestamp != nil || n.StartOrEnd != 0
+		case *parser.SubqueryExpr:
+			found = found || n.Timestamp != nil || n.StartOrEnd != 0
+		}
+		return nil
+	})
+	return found
+}
+
+// alignDown 把 ts 向下对齐到 start + k*step
+func alignDown(ts, start, step int64) int64 {
+	if ts < start {
+		return start - step
+	}
+	return start + (ts-start)/step*step
+}
+
+func parseTimeMillis(s string) (int64, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(math.Round(seconds * 1000)), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, err
+	}
+	return t.UnixMilli(), nil
+}
+
+func formatTimeMillis(ms int64) string {
+	return strconv.FormatFloat(float64(ms)/1000, 'f', -1, 64)
+}
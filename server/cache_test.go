@@ -0,0 +1,209 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// matrixData 返回一个 matrix 结果，series 的 key 为 __name__，取值为样本的毫秒时间戳
+func matrixData(series map[string][]int64) *queryData {
+	var streams []string
+	for _, name := range slices.Sorted(maps.Keys(series)) {
+		var values []string
+		for _, ms := range series[name] {
+			values = append(values, fmt.Sprintf(`[%s,"1"]`, formatTimeMillis(ms)))
+		}
+		streams = append(streams, fmt.Sprintf(`{"metric":{"__name__":%q},"values":[%s]}`, name, strings.Join(values, ",")))
+	}
+	return &queryData{ResultType: "matrix", Result: json.RawMessage("[" + strings.Join(streams, ",") + "]")}
+}
+
+// matrixTimestamps 返回 matrix 结果中每条序列的样本时间戳，序列只有 histograms 时同样返回其时间戳
+func matrixTimestamps(t *testing.T, data *queryData) map[string][]int64 {
+	t.Helper()
+	var streams []*sampleStream
+	if err := json.Unmarshal(data.Result, &streams); err != nil {
+		t.Fatal(err)
+	}
+	out := make(map[string][]int64)
+	for _, s := range streams {
+		for _, raw := range slices.Concat(s.Values, s.Histograms) {
+			ts, err := pointTimestamp(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			out[s.Metric["__name__"]] = append(out[s.Metric["__name__"]], int64(math.Round(ts*1000)))
+		}
+	}
+	return out
+}
+
+func TestAlignDown(t *testing.T) {
+	tests := []struct {
+		ts, start, step int64
+		want            int64
+	}{
+		{10, 10, 10, 10},
+		{19, 10, 10, 10},
+		{20, 10, 10, 20},
+		{25, 10, 10, 20},
+		{9, 10, 10, 0},
+		{1500, 0, 1000, 1000},
+	}
+
+	for _, tt := range tests {
+		if got := alignDown(tt.ts, tt.start, tt.step); got != tt.want {
+			t.Errorf("alignDown(%d, %d, %d) = %d, want %d", tt.ts, tt.start, tt.step, got, tt.want)
+		}
+	}
+}
+
+func TestMissingRanges(t *testing.T) {
+	tests := []struct {
+		name    string
+		extents [][2]int64
+		want    [][2]int64
+	}{
+		{"empty cache", nil, [][2]int64{{0, 100}}},
+		{"fully cached", [][2]int64{{0, 100}}, nil},
+		{"cached range covers more", [][2]int64{{-50, 200}}, nil},
+		{"cached middle", [][2]int64{{20, 50}}, [][2]int64{{0, 10}, {60, 100}}},
+		{"cached head", [][2]int64{{0, 50}}, [][2]int64{{60, 100}}},
+		{"cached tail", [][2]int64{{50, 100}}, [][2]int64{{0, 40}}},
+		{"gap between extents", [][2]int64{{0, 30}, {60, 100}}, [][2]int64{{40, 50}}},
+		{"adjacent extents", [][2]int64{{0, 50}, {60, 100}}, nil},
+		{"before range", [][2]int64{{-50, -10}}, [][2]int64{{0, 100}}},
+		{"after range", [][2]int64{{200, 300}}, [][2]int64{{0, 100}}},
+		{"unaligned extent", [][2]int64{{25, 55}}, [][2]int64{{0, 20}, {60, 100}}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var extents []*cacheExtent
+			for _, e := range tt.extents {
+				extents = append(extents, &cacheExtent{start: e[0], end: e[1]})
+			}
+			got := missingRanges(extents, 0, 100, 10)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMergeExtents(t *testing.T) {
+	type extent struct {
+		start, end int64
+		samples    []int64
+	}
+	tests := []struct {
+		name    string
+		extents []extent
+		want    []extent
+	}{
+		{
+			name:    "overlapping",
+			extents: []extent{{0, 50, []int64{0, 10, 20, 30, 40, 50}}, {30, 80, []int64{30, 40, 50, 60, 70, 80}}},
+			want:    []extent{{0, 80, []int64{0, 10, 20, 30, 40, 50, 60, 70, 80}}},
+		},
+		{
+			name:    "adjacent",
+			extents: []extent{{0, 20, []int64{0, 10, 20}}, {30, 40, []int64{30, 40}}},
+			want:    []extent{{0, 40, []int64{0, 10, 20, 30, 40}}},
+		},
+		{
+			name:    "gap",
+			extents: []extent{{0, 20, []int64{0, 10, 20}}, {40, 50, []int64{40, 50}}},
+			want:    []extent{{0, 20, []int64{0, 10, 20}}, {40, 50, []int64{40, 50}}},
+		},
+		{
+			name:    "unsorted",
+			extents: []extent{{30, 40, []int64{30, 40}}, {0, 20, []int64{0, 10, 20}}},
+			want:    []extent{{0, 40, []int64{0, 10, 20, 30, 40}}},
+		},
+		{
+			name:    "contained",
+			extents: []extent{{0, 50, []int64{0, 10, 20, 30, 40, 50}}, {20, 30, []int64{20, 30}}},
+			want:    []extent{{0, 50, []int64{0, 10, 20, 30, 40, 50}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var extents []*cacheExtent
+			for _, e := range tt.extents {
+				extents = append(extents, &cacheExtent{start: e.start, end: e.end, data: matrixData(map[string][]int64{"up": e.samples})})
+			}
+			merged, err := mergeExtents(extents, 10)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(merged) != len(tt.want) {
+				t.Fatalf("got %d extents, want %d", len(merged), len(tt.want))
+			}
+			for i, e := range merged {
+				want := tt.want[i]
+				if e.start != want.start || e.end != want.end {
+					t.Errorf("extent %d: got [%d, %d], want [%d, %d]", i, e.start, e.end, want.start, want.end)
+				}
+				if got := matrixTimestamps(t, e.data)["up"]; !slices.Equal(got, want.samples) {
+					t.Errorf("extent %d: got samples %v, want %v", i, got, want.samples)
+				}
+			}
+		})
+	}
+}
+
+func TestExtractRange(t *testing.T) {
+	data := matrixData(map[string][]int64{
+		"a": {1000, 2000, 3000, 4000, 5000},
+		"b": {5000, 6000},
+		"c": {2500},
+	})
+
+	tests := []struct {
+		name       string
+		start, end int64
+		want       map[string][]int64
+	}{
+		{"whole range", 0, 10000, map[string][]int64{"a": {1000, 2000, 3000, 4000, 5000}, "b": {5000, 6000}, "c": {2500}}},
+		{"inclusive bounds", 2000, 4000, map[string][]int64{"a": {2000, 3000, 4000}, "c": {2500}}},
+		{"series dropped", 5000, 6000, map[string][]int64{"a": {5000}, "b": {5000, 6000}}},
+		{"empty", 7000, 8000, map[string][]int64{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			extracted, err := extractRange(data, tt.start, tt.end)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := matrixTimestamps(t, extracted)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got %v, want %v", got, tt.want)
+			}
+			for name, want := range tt.want {
+				if !slices.Equal(got[name], want) {
+					t.Errorf("series %s: got %v, want %v", name, got[name], want)
+				}
+			}
+		})
+	}
+
+	t.Run("histograms", func(t *testing.T) {
+		input := &queryData{ResultType: "matrix", Result: json.RawMessage(
+			`[{"metric":{"__name__":"h"},"histograms":[[1,{"count":"1"}],[2,{"count":"2"}],[3,{"count":"3"}]]}]`)}
+		extracted, err := extractRange(input, 2000, 3000)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := matrixTimestamps(t, extracted)["h"]; !slices.Equal(got, []int64{2000, 3000}) {
+			t.Errorf("got %v, want [2000 3000]", got)
+		}
+	})
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhengtianbao/promproxy/config"
+)
+
+// newClientTransport 按 prometheus.client 配置创建访问后端的 transport
+func newClientTransport(cfg config.ClientConfig) (http.RoundTripper, error) {
+	tlsConfig, err := newTLSConfig(cfg.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	var transport http.RoundTripper = &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		TLSClientConfig:       tlsConfig,
+		TLSHandshakeTimeout:   cfg.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: cfg.ResponseHeaderTimeout,
+		IdleConnTimeout:       cfg.IdleConnTimeout,
+		MaxIdleConns:          cfg.MaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.MaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.MaxConnsPerHost,
+		ForceAttemptHTTP2:     true,
+	}
+
+	auth := &authTransport{next: transport, headers: cfg.Headers}
+	switch {
+	case cfg.BasicAuth != nil && (cfg.BearerToken != "" || cfg.BearerTokenFile != ""):
+		return nil, errors.New("basic_auth and bearer_token cannot both be configured")
+	case cfg.BasicAuth != nil:
+		auth.username = cfg.BasicAuth.Username
+		auth.password = newSecret(cfg.BasicAuth.Password, cfg.BasicAuth.PasswordFile)
+	case cfg.BearerToken != "" || cfg.BearerTokenFile != "":
+		auth.token = newSecret(cfg.BearerToken, cfg.BearerTokenFile)
+	}
+	if auth.password == nil && auth.token == nil && len(auth.headers) == 0 {
+		return transport, nil
+	}
+	return auth, nil
+}
+
+func newTLSConfig(cfg config.TLSConfig) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         cfg.ServerName,
+		InsecureSkipVerify: cfg.InsecureSkipVerify,
+	}
+
+	if cfg.CAFile != "" {
+		data, err := os.ReadFile(cfg.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", cfg.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if cfg.CertFile != "" || cfg.KeyFile != "" {
+		if cfg.CertFile == "" || cfg.KeyFile == "" {
+			return nil, errors.New("tls cert_file and key_file must be configured together")
+		}
+		cert := &clientCertificate{certFile: cfg.CertFile, keyFile: cfg.KeyFile}
+		if _, err := cert.get(nil); err != nil {
+			return nil, err
+		}
+		tlsConfig.GetClientCertificate = cert.get
+	}
+
+	return tlsConfig, nil
+}
+
+// clientCertificate 在证书或私钥文件变化后重新加载客户端证书
+type clientCertificate struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.Mutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func (c *clientCertificate) get(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	modTime, err := latestModTime(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, err
+	}
+	if c.cert != nil && modTime.Equal(c.modTime) {
+		return c.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load client certificate: %v", err)
+	}
+	c.cert = &cert
+	c.modTime = modTime
+	return c.cert, nil
+}
+
+func latestModTime(files ...string) (time.Time, error) {
+	var latest time.Time
+	for _, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// secret 为配置中的凭据，指定文件时在文件变化后重新读取
+type secret struct {
+	value string
+	file  string
+
+	mu      sync.Mutex
+	modTime time.Time
+}
+
+func newSecret(value, file string) *secret {
+	return &secret{value: value, file: file}
+}
+
+func (s *secret) get() (string, error) {
+	if s.file == "" {
+		return s.value, nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info, err := os.Stat(s.file)
+	if err != nil {
+		return "", err
+	}
+	if !info.ModTime().Equal(s.modTime) {
+		data, err := os.ReadFile(s.file)
+		if err != nil {
+			return "", err
+		}
+		s.value = strings.TrimSpace(string(data))
+		s.modTime = info.ModTime()
+	}
+	return s.value, nil
+}
+
+// authTransport 为发往后端的请求添加凭据和自定义 header
+type authTransport struct {
+	next     http.RoundTripper
+	headers  map[string]string
+	username string
+	password *secret
+	token    *secret
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+
+	switch {
+	case t.password != nil:
+		password, err := t.password.get()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read basic auth password: %v", err)
+		}
+		req.SetBasicAuth(t.username, password)
+	case t.token != nil:
+		token, err := t.token.get()
+		if err != nil {
+			return nil, fmt.Errorf("unable to read bearer token: %v", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return t.next.RoundTrip(req)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"net/url"
+	"sync"
+
+	"github.com/zhengtianbao/promproxy/config"
+)
+
+// inflightCall 为正在执行的请求，完成后 followers 复用它的响应
+type inflightCall struct {
+	done   chan struct{}
+	ok     bool
+	status int
+	header http.Header
+	body   []byte
+	// leader 的校验结果，供 followers 的审计日志使用
+	info *requestInfo
+}
+
+// coalescer 合并相同的并发请求，同一时刻只有 leader 访问后端
+type coalescer struct {
+	maxBodyBytes int64
+
+	mu    sync.Mutex
+	calls map[string]*inflightCall
+}
+
+func newCoalescer(cfg config.CoalescingConfig) *coalescer {
+	return &coalescer{
+		maxBodyBytes: cfg.MaxBodyBytes,
+		calls:        make(map[string]*inflightCall),
+	}
+}
+
+// do 以 leader 身份执行 handler，或等待相同 key 的 leader 完成后复制它的响应
+func (c *coalescer) do(w http.ResponseWriter, r *http.Request, key string, handler http.HandlerFunc) {
+	c.mu.Lock()
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+
+		select {
+		case <-call.done:
+		case <-r.Context().Done():
+			writeAPIError(w, statusClientClosedRequest, errorCanceled, "request canceled by client")
+			return
+		}
+
+		// leader 的响应不完整、过大或 leader 被取消时自行执行
+		if !call.ok {
+			coalescedRequests.WithLabelValues("fallback").Inc()
+			handler(w, r)
+			return
+		}
+
+		coalescedRequests.WithLabelValues("shared").Inc()
+		if info := requestInfoFrom(r.Context()); info != nil && call.info != nil {
+			info.spaces = call.info.spaces
+			info.violations = call.info.violations
+			info.backendStatus.Store(call.info.backendStatus.Load())
+		}
+		for key, values := range call.header {
+			if key != requestIDHeader {
+				w.Header()[key] = values
+			}
+		}
+		w.WriteHeader(call.status)
+		w.Write(call.body)
+		return
+	}
+
+	call := &inflightCall{done: make(chan struct{}), info: requestInfoFrom(r.Context())}
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	recorder := &recordingWriter{ResponseWriter: w, status: http.StatusOK, maxBytes: c.maxBodyBytes}
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+
+		// handler 中途 panic（如响应超限被中断）时 ok 保持为 false
+		call.status = recorder.status
+		call.header = recorder.Header().Clone()
+		call.body = recorder.body.Bytes()
+		close(call.done)
+	}()
+
+	handler(recorder, r)
+	// leader 的客户端取消或超时时，响应不代表查询的结果
+	call.ok = !recorder.overflow && recorder.status != statusClientClosedRequest && r.Context().Err() == nil
+}
+
+// recordingWriter 在写回客户端的同时保存响应
+type recordingWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	maxBytes int64
+	overflow bool
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if !rw.overflow {
+		if rw.maxBytes > 0 && int64(rw.body.Len()+len(b)) > rw.maxBytes {
+			rw.overflow = true
+			rw.body.Reset()
+		} else {
+			rw.body.Write(b)
+		}
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recordingWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// coalesceKey 由租户、路径、Accept-Encoding 和规范化后的参数组成，查询语句按解析后的形式比较；
+// 后端可能按 Accept-Encoding 返回压缩的响应，不能复用给没有请求压缩的客户端
+func (p *ProxyServer) coalesceKey(r *http.Request, params url.Values) string {
+	normalized := url.Values{}
+	for key, values := range params {
+		normalized[key] = values
+	}
+	if expr, err := p.current().QueryParser.ParseExpr(params.Get("query")); err == nil {
+		normalized.Set("query", expr.String())
+	}
+	return p.tenant(r) + "\x00" + r.URL.Path + "\x00" + r.Header.Get("Accept-Encoding") + "\x00" + normalized.Encode()
+}
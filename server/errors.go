@@ -0,0 +1,118 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/zhengtianbao/promproxy/middleware"
+)
+
+// Prometheus API 的错误类型
+const (
+	errorBadData     = "bad_data"
+	errorTimeout     = "timeout"
+	errorCanceled    = "canceled"
+	errorInternal    = "internal"
+	errorUnavailable = "unavailable"
+	errorNotFound    = "not_found"
+)
+
+// statusClientClosedRequest 为客户端在响应前断开时记录的非标准状态码
+const statusClientClosedRequest = 499
+
+type apiError struct {
+	Status     string                 `json:"status"`
+	ErrorType  string                 `json:"errorType"`
+	Error      string                 `json:"error"`
+	Violations []middleware.Violation `json:"violations,omitempty"`
+}
+
+// writeAPIError 以 Prometheus API 的格式返回错误
+func writeAPIError(w http.ResponseWriter, status int, errorType, msg string) {
+	writeError(w, status, apiError{
+		Status:    "error",
+		ErrorType: errorType,
+		Error:     msg,
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, body apiError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+// writeBackendError 把查询后端时的错误转换为对应的 API 错误
+func writeBackendError(w http.ResponseWriter, err error) {
+	var limitErr *responseLimitError
+	var backendErr *backendError
+	switch {
+	case errors.As(err, &limitErr):
+		writeAPIError(w, http.StatusUnprocessableEntity, errorBadData, err.Error())
+	case errors.As(err, &backendErr):
+		writeAPIError(w, backendErr.statusCode, backendErr.errorType, backendErr.msg)
+	case errors.Is(err, context.DeadlineExceeded):
+		writeAPIError(w, http.StatusGatewayTimeout, errorTimeout, "timed out waiting for Prometheus")
+	case errors.Is(err, context.Canceled):
+		writeAPIError(w, statusClientClosedRequest, errorCanceled, "request canceled by client")
+	case errors.Is(err, errNoHealthyBackend):
+		writeAPIError(w, http.StatusServiceUnavailable, errorUnavailable, err.Error())
+	default:
+		writeAPIError(w, http.StatusBadGateway, errorUnavailable, err.Error())
+	}
+}
+
+// writeValidationError 按校验错误的类别返回：违反访问策略为 403，超出限额为 422，
+// 校验依赖的后端查询失败为 502，其余为 400；违规明细在 violations 中一并返回
+func writeValidationError(w http.ResponseWriter, err error) {
+	var violations middleware.Violations
+	if errors.As(err, &violations) {
+		writeError(w, validationStatus(violations.Kind()), apiError{
+			Status:     "error",
+			ErrorType:  errorBadData,
+			Error:      err.Error(),
+			Violations: violations,
+		})
+		return
+	}
+
+	var validationErr *middleware.ValidationError
+	if !errors.As(err, &validationErr) {
+		writeAPIError(w, http.StatusBadRequest, errorBadData, err.Error())
+		return
+	}
+	if validationErr.Kind == middleware.KindUnavailable {
+		writeAPIError(w, http.StatusBadGateway, errorUnavailable, err.Error())
+		return
+	}
+	writeAPIError(w, validationStatus(validationErr.Kind), errorBadData, err.Error())
+}
+
+func validationStatus(kind middleware.ErrorKind) int {
+	switch kind {
+	case middleware.KindDenied:
+		return http.StatusForbidden
+	case middleware.KindLimit:
+		return http.StatusUnprocessableEntity
+	case middleware.KindUnavailable:
+		return http.StatusBadGateway
+	default:
+		return http.StatusBadRequest
+	}
+}
+
+// writeSchedulerError 返回排队失败的错误：队列已满或排队超时为 429 并带有 Retry-After
+func writeSchedulerError(w http.ResponseWriter, err error, retryAfter int) {
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		writeAPIError(w, statusClientClosedRequest, errorCanceled, "request canceled by client")
+	case errors.Is(err, errQueueFull), errors.Is(err, errQueueTimeout):
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeAPIError(w, http.StatusTooManyRequests, errorUnavailable, err.Error())
+	default:
+		writeAPIError(w, http.StatusServiceUnavailable, errorUnavailable, err.Error())
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/zhengtianbao/promproxy/config"
+)
+
+const partialResponseWarn = "warn"
+
+type fanoutResult struct {
+	backend string
+	resp    *apiResponse
+	err     error
+}
+
+// executeQuery 在每个后端池上并行执行查询并合并结果，返回结果与实际使用的后端。
+// 合并只按标签集去重，要求每个 space 的数据完整地位于一个后端上，跨 space 的聚合结果不会被重新计算，
+// 多个后端返回相同标签集的序列时在 warnings 中提示
+func (p *ProxyServer) executeQuery(ctx context.Context, pools []*backendPool, path string, params url.Values, header http.Header, limits config.LimitsConfig) (*apiResponse, []string, error) {
+	results := make([]fanoutResult, len(pools))
+	var wg sync.WaitGroup
+	for i, pool := range pools {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b, err := pool.pick()
+			if err != nil {
+				results[i].err = err
+				return
+			}
+			results[i].resp, b, results[i].err = p.queryBackend(ctx, b, path, params, header, limits)
+			results[i].backend = b.url.Host
+		}()
+	}
+	wg.Wait()
+
+	var backends, warnings, infos []string
+	var datas []*queryData
+	var firstErr error
+	for _, result := range results {
+		if result.backend != "" {
+			backends = append(backends, result.backend)
+		}
+		if result.err != nil {
+			if len(pools) > 1 {
+				requestLogger(ctx).Warn("Fan-out query failed", "backend", result.backend, "err", result.err)
+			}
+			if firstErr == nil {
+				firstErr = result.err
+			}
+			warnings = append(warnings, fmt.Sprintf("partial response: %v", result.err))
+			continue
+		}
+		datas = append(datas, result.resp.Data)
+		warnings = uniqueStrings(warnings, result.resp.Warnings)
+		infos = uniqueStrings(infos, result.resp.Infos)
+	}
+
+	if firstErr != nil && (p.config.Prometheus.Fanout.PartialResponse != partialResponseWarn || len(datas) == 0) {
+		return nil, backends, firstErr
+	}
+
+	data, duplicates, err := mergeSeries(datas)
+	if err != nil {
+		return nil, backends, err
+	}
+	if len(datas) > 1 && data.ResultType != "vector" && data.ResultType != "matrix" {
+		warnings = append(warnings, fmt.Sprintf("%s results of %d backends cannot be merged, only the first one is returned", data.ResultType, len(datas)))
+	}
+	// 跨后端的聚合结果标签集相同，例如 sum(x{space=~"a|b"}) 各返回一条 {}，只保留第一个后端的部分结果
+	if duplicates > 0 {
+		warnings = append(warnings, fmt.Sprintf("%d series were returned by more than one backend and only the first result is kept; "+
+			"aggregations across spaces on different backends are partial", duplicates))
+	}
+	if err := checkMergedLimits(data, limits); err != nil {
+		return nil, backends, err
+	}
+
+	return &apiResponse{
+		Status:   "success",
+		Data:     data,
+		Warnings: warnings,
+		Infos:    infos,
+	}, backends, nil
+}
+
+// fanoutQuery 在多个后端上执行查询并把合并后的结果写回客户端
+func (p *ProxyServer) fanoutQuery(w http.ResponseWriter, r *http.Request, pools []*backendPool, limits config.LimitsConfig) error {
+	params, err := readForm(r)
+	if err != nil {
+		return err
+	}
+
+	resp, backends, err := p.executeQuery(r.Context(), pools, r.URL.Path, params, r.Header, limits)
+	w.Header().Set(backendHeader, strings.Join(backends, ","))
+	if err != nil {
+		writeBackendError(w, err)
+		return nil
+	}
+
+	writeAPIResponse(w, resp)
+	return nil
+}
+
+// seriesCount 返回 vector 或 matrix 结果中的序列数
+func seriesCount(data *queryData) int {
+	if data.ResultType != "vector" && data.ResultType != "matrix" {
+		return 0
+	}
+	var streams []json.RawMessage
+	if err := json.Unmarshal(data.Result, &streams); err != nil {
+		return 0
+	}
+	return len(streams)
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/zhengtianbao/promproxy/config"
+)
+
+type limitsContextKey struct{}
+
+func (p *ProxyServer) newReverseProxy() *httputil.ReverseProxy {
+	forward := p.config.Prometheus.Forward
+
+	return &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			b := pr.In.Context().Value(backendContextKey{}).(*backend)
+			pr.SetURL(b.url)
+			filterHeaders(pr.Out.Header, forward.RequestHeaders)
+			pr.SetXForwarded()
+		},
+		Transport:      p.backends,
+		FlushInterval:  forward.FlushInterval,
+		ModifyResponse: p.modifyResponse,
+		ErrorHandler:   p.handleProxyError,
+	}
+}
+
+func (p *ProxyServer) modifyResponse(resp *http.Response) error {
+	filterHeaders(resp.Header, p.config.Prometheus.Forward.ResponseHeaders)
+
+	// 请求重试后可能由其他后端返回响应
+	if b, ok := resp.Request.Context().Value(backendContextKey{}).(*backend); ok {
+		resp.Header.Set(backendHeader, b.url.Host)
+	}
+
+	limits, ok := resp.Request.Context().Value(limitsContextKey{}).(config.LimitsConfig)
+	if !ok {
+		return nil
+	}
+
+	if limits.MaxResponseBytes > 0 && resp.ContentLength > limits.MaxResponseBytes {
+		return &responseLimitError{msg: fmt.Sprintf("response size %d bytes exceeds the limit of %d bytes",
+			resp.ContentLength, limits.MaxResponseBytes)}
+	}
+	if limits.MaxResponseBytes <= 0 && limits.MaxResponseSeries <= 0 {
+		return nil
+	}
+
+	body := newLimitedBody(resp.Body, limits.MaxResponseBytes, limits.MaxResponseSeries)
+
+	// 先读取响应开头，较小的超限响应仍可以返回明确的错误；
+	// 之后再超限时响应头已发送，ReverseProxy 会中断连接，避免客户端收到被截断但看似完整的结果
+	head := make([]byte, 32*1024)
+	n, err := io.ReadFull(body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return err
+	}
+
+	resp.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head[:n]), body), resp.Body}
+	return nil
+}
+
+func (p *ProxyServer) handleProxyError(w http.ResponseWriter, r *http.Request, err error) {
+	if b, ok := r.Context().Value(backendContextKey{}).(*backend); ok {
+		w.Header().Set(backendHeader, b.url.Host)
+	}
+
+	var limitErr *responseLimitError
+	switch {
+	case errors.As(err, &limitErr):
+		requestLogger(r.Context()).Warn("Response limit exceeded", "path", r.URL.Path, "err", err)
+		writeAPIError(w, http.StatusUnprocessableEntity, errorBadData, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		requestLogger(r.Context()).Warn("Timeout proxying to Prometheus", "err", err)
+		writeAPIError(w, http.StatusGatewayTimeout, errorTimeout, "timed out waiting for Prometheus")
+	case errors.Is(err, context.Canceled):
+		// 客户端已断开，无需返回内容
+		writeAPIError(w, statusClientClosedRequest, errorCanceled, "request canceled by client")
+	default:
+		requestLogger(r.Context()).Error("Error proxying to Prometheus", "err", err)
+		writeAPIError(w, http.StatusBadGateway, errorUnavailable, "error proxying to Prometheus")
+	}
+}
+
+// filterHeaders 按允许和禁止列表过滤 header，允许列表为空时不限制
+func filterHeaders(header http.Header, filter config.HeaderFilter) {
+	for key := range header {
+		if len(filter.Allow) > 0 && !containsHeader(filter.Allow, key) {
+			header.Del(key)
+			continue
+		}
+		if containsHeader(filter.Deny, key) {
+			header.Del(key)
+		}
+	}
+}
+
+func containsHeader(headers []string, key string) bool {
+	return slices.ContainsFunc(headers, func(h string) bool {
+		return strings.EqualFold(h, key)
+	})
+}
+
+// maxFormBytes 为表单请求体的大小上限，与 Prometheus 一致
+const maxFormBytes = 10 << 20
+
+// readForm 返回请求的 URL 参数与表单参数，并恢复请求体以便继续转发。
+// 请求体超过 maxFormBytes 时返回错误，之后再次读取同样返回该错误
+func readForm(r *http.Request) (url.Values, error) {
+	if r.Method != http.MethodPost || r.Body == nil ||
+		!strings.HasPrefix(r.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		return r.URL.Query(), nil
+	}
+
+	data, err := io.ReadAll(http.MaxBytesReader(nil, r.Body, maxFormBytes))
+	r.Body.Close()
+	if err != nil {
+		r.Body = errorBody{err}
+		return nil, err
+	}
+	r.Body = io.NopCloser(bytes.NewReader(data))
+
+	form, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// 与 Prometheus 一致，表单参数优先于 URL 参数
+	params := r.URL.Query()
+	for key, values := range form {
+		params[key] = values
+	}
+	return params, nil
+}
+
+// errorBody 为读取失败的请求体，每次读取都返回同一个错误
+type errorBody struct {
+	err error
+}
+
+func (b errorBody) Read([]byte) (int, error) { return 0, b.err }
+
+func (b errorBody) Close() error { return nil }
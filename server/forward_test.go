@@ -0,0 +1,40 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestReadForm(t *testing.T) {
+	newRequest := func(body string) *http.Request {
+		r, err := http.NewRequest(http.MethodPost, "/api/v1/query?query=a&time=1", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		return r
+	}
+
+	r := newRequest("query=up")
+	params, err := readForm(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if params.Get("query") != "up" || params.Get("time") != "1" {
+		t.Errorf("got %v, want form parameters overriding URL parameters", params)
+	}
+	if body, _ := io.ReadAll(r.Body); string(body) != "query=up" {
+		t.Errorf("request body was not restored, got %q", body)
+	}
+
+	r = newRequest("query=" + strings.Repeat("a", maxFormBytes))
+	var maxBytesErr *http.MaxBytesError
+	for i := range 2 {
+		if _, err := readForm(r); !errors.As(err, &maxBytesErr) {
+			t.Errorf("read %d: got %v, want a MaxBytesError", i, err)
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/expfmt"
+)
+
+// handleMetrics 以 Prometheus 文本格式（或客户端协商的格式）输出代理自身的指标
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	families, err := prometheus.DefaultGatherer.Gather()
+	if err != nil {
+		slog.Error("Error gathering metrics", "err", err)
+		if len(families) == 0 {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	format := expfmt.Negotiate(r.Header)
+	w.Header().Set("Content-Type", string(format))
+	enc := expfmt.NewEncoder(w, format)
+	for _, family := range families {
+		if err := enc.Encode(family); err != nil {
+			slog.Error("Error encoding metrics", "err", err)
+			return
+		}
+	}
+	if closer, ok := enc.(expfmt.Closer); ok {
+		closer.Close()
+	}
+}
+
+// instrument 按接口类别、状态码和租户记录请求数和耗时并输出访问日志，健康检查和指标接口不计入
+func (p *ProxyServer) instrument(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || r.URL.Path == "/-/ready" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		start := time.Now()
+		info := &requestInfo{id: requestID(r)}
+		w.Header().Set(requestIDHeader, info.id)
+		r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info))
+		// 先读取参数，处理过程中请求体会被转发给后端
+		params, _ := readForm(r)
+
+		sw := &statusWriter{ResponseWriter: w}
+		// 响应中途被中断（如超出响应大小限制）时处理函数以 http.ErrAbortHandler panic，
+		// 仍然记录指标、访问日志和审计日志后再继续 panic
+		defer func() {
+			aborted := recover()
+			duration := time.Since(start)
+
+			code := strconv.Itoa(sw.statusCode())
+			if aborted != nil {
+				code = "aborted"
+			}
+			endpoint := endpointClass(r.URL.Path)
+			tenant := p.tenantLabel(r)
+			requests.WithLabelValues(endpoint, code, tenant).Inc()
+			requestDuration.WithLabelValues(endpoint, tenant).Observe(duration.Seconds())
+			p.accessLog(r, info, sw, params, duration, aborted != nil)
+			if p.audit != nil {
+				p.audit.record(r, p.tenant(r), info, sw, params, aborted != nil)
+			}
+
+			if aborted != nil {
+				panic(aborted)
+			}
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+// tenantLabel 返回用作指标标签的租户，未在配置中声明的租户归入空标签，避免请求头取值造成标签数量无限增长
+func (p *ProxyServer) tenantLabel(r *http.Request) string {
+	tenant := p.tenant(r)
+	if _, ok := p.current().Config.Tenants[tenant]; !ok {
+		return ""
+	}
+	return tenant
+}
+
+// statusWriter 记录写回客户端的状态码和字节数
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(b)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// statusCode 返回响应的状态码，处理函数没有写入任何内容时为 200
+func (sw *statusWriter) statusCode() int {
+	if sw.status == 0 {
+		return http.StatusOK
+	}
+	return sw.status
+}
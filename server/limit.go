@@ -0,0 +1,126 @@
+package server
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/zhengtianbao/promproxy/config"
+)
+
+// responseLimitError 表示后端响应超出了租户限额
+type responseLimitError struct {
+	msg string
+}
+
+func (e *responseLimitError) Error() string {
+	return e.msg
+}
+
+// checkMergedLimits 检查合并后的结果是否超出租户限额。每个后端响应在读取时已分别检查，
+// 但多个响应合并后仍可能超出限额
+func checkMergedLimits(data *queryData, limits config.LimitsConfig) error {
+	if limits.MaxResponseSeries > 0 && seriesCount(data) > limits.MaxResponseSeries {
+		return &responseLimitError{msg: fmt.Sprintf("response contains more than %d series", limits.MaxResponseSeries)}
+	}
+	if limits.MaxResponseBytes > 0 && int64(len(data.Result)) > limits.MaxResponseBytes {
+		return &responseLimitError{msg: fmt.Sprintf("response size exceeds the limit of %d bytes", limits.MaxResponseBytes)}
+	}
+	return nil
+}
+
+type jsonContainer struct {
+	kind byte
+	key  string
+}
+
+// limitedBody 在转发过程中统计响应字节数，并增量解析 data.result 数组统计序列数
+type limitedBody struct {
+	body      io.Reader
+	maxBytes  int64
+	maxSeries int
+
+	bytes  int64
+	series int
+
+	stack      []jsonContainer
+	inString   bool
+	escape     bool
+	str        []byte
+	lastString string
+	resultLvl  int
+}
+
+func newLimitedBody(body io.Reader, maxBytes int64, maxSeries int) *limitedBody {
+	return &limitedBody{
+		body:      body,
+		maxBytes:  maxBytes,
+		maxSeries: maxSeries,
+	}
+}
+
+func (l *limitedBody) Read(b []byte) (int, error) {
+	n, err := l.body.Read(b)
+
+	l.bytes += int64(n)
+	if l.maxBytes > 0 && l.bytes > l.maxBytes {
+		return 0, &responseLimitError{msg: fmt.Sprintf("response size exceeds the limit of %d bytes", l.maxBytes)}
+	}
+
+	if l.maxSeries > 0 {
+		l.scan(b[:n])
+		if l.series > l.maxSeries {
+			return 0, &responseLimitError{msg: fmt.Sprintf("response contains more than %d series", l.maxSeries)}
+		}
+	}
+
+	return n, err
+}
+
+func (l *limitedBody) scan(data []byte) {
+	for _, c := range data {
+		if l.inString {
+			switch {
+			case l.escape:
+				l.escape = false
+			case c == '\\':
+				l.escape = true
+			case c == '"':
+				l.inString = false
+				l.lastString = string(l.str)
+				l.str = l.str[:0]
+				continue
+			}
+			// 只关心较短的 key
+			if len(l.str) < 16 {
+				l.str = append(l.str, c)
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			l.inString = true
+		case ':':
+			if len(l.stack) > 0 {
+				l.stack[len(l.stack)-1].key = l.lastString
+			}
+		case '{', '[':
+			if c == '[' && len(l.stack) == 2 &&
+				l.stack[0].kind == '{' && l.stack[0].key == "data" &&
+				l.stack[1].kind == '{' && l.stack[1].key == "result" {
+				l.resultLvl = 3
+			}
+			if c == '{' && l.resultLvl > 0 && len(l.stack) == l.resultLvl {
+				l.series++
+			}
+			l.stack = append(l.stack, jsonContainer{kind: c})
+		case '}', ']':
+			if len(l.stack) > 0 {
+				l.stack = l.stack[:len(l.stack)-1]
+			}
+			if len(l.stack) < l.resultLvl {
+				l.resultLvl = 0
+			}
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/zhengtianbao/promproxy/config"
+	"github.com/zhengtianbao/promproxy/middleware"
+	"gopkg.in/natefinch/lumberjack.v2"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// NewLogger 按配置创建日志记录器，返回的 io.Closer 用于退出时关闭日志文件
+func NewLogger(cfg config.LoggingConfig) (*slog.Logger, io.Closer, error) {
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(cfg.Level)); err != nil {
+		return nil, nil, err
+	}
+
+	var out io.WriteCloser
+	switch cfg.Output {
+	case "stdout":
+		out = nopCloser{os.Stdout}
+	case "stderr":
+		out = nopCloser{os.Stderr}
+	default:
+		out = newLogFile(cfg.File)
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Format == "logfmt" {
+		return slog.New(slog.NewTextHandler(out, opts)), out, nil
+	}
+	return slog.New(slog.NewJSONHandler(out, opts)), out, nil
+}
+
+// newLogFile 返回按大小轮转的日志文件
+func newLogFile(cfg config.LogFileConfig) *lumberjack.Logger {
+	return &lumberjack.Logger{
+		Filename:   cfg.Filename,
+		MaxSize:    cfg.MaxSizeMB,
+		MaxBackups: cfg.MaxBackups,
+		MaxAge:     cfg.MaxAgeDays,
+		Compress:   cfg.Compress,
+	}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
+
+type requestInfoKey struct{}
+
+// requestInfo 在处理请求的过程中收集访问日志和审计日志需要的信息
+type requestInfo struct {
+	id            string
+	queueWait     atomic.Int64
+	backend       atomic.Int64
+	backendStatus atomic.Int32
+
+	// 由处理请求的 goroutine 写入，请求结束后读取
+	spaces     []string
+	violations middleware.Violations
+}
+
+func requestInfoFrom(ctx context.Context) *requestInfo {
+	info, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return info
+}
+
+// requestID 沿用客户端传入的请求 ID，没有时生成一个新的
+func requestID(r *http.Request) string {
+	if id := r.Header.Get(requestIDHeader); id != "" && len(id) <= 128 {
+		return id
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+// requestLogger 返回带有请求 ID 的日志记录器
+func requestLogger(ctx context.Context) *slog.Logger {
+	if info := requestInfoFrom(ctx); info != nil {
+		return slog.With("request_id", info.id)
+	}
+	return slog.Default()
+}
+
+// accessLog 在请求结束后记录一条访问日志，aborted 表示响应中途被中断
+func (p *ProxyServer) accessLog(r *http.Request, info *requestInfo, sw *statusWriter, params map[string][]string, duration time.Duration, aborted bool) {
+	get := func(key string) string {
+		if values := params[key]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+
+	attrs := []slog.Attr{
+		slog.String("request_id", info.id),
+		slog.String("method", r.Method),
+		slog.String("path", r.URL.Path),
+		slog.String("remote_addr", r.RemoteAddr),
+		slog.String("tenant", p.tenant(r)),
+	}
+	// time 参数记为 eval_time，避免与日志记录自身的 time 字段冲突
+	for _, param := range []struct{ key, attr string }{
+		{"query", "query"}, {"start", "start"}, {"end", "end"}, {"time", "eval_time"}, {"step", "step"},
+	} {
+		if value := get(param.key); value != "" {
+			attrs = append(attrs, slog.String(param.attr, value))
+		}
+	}
+	attrs = append(attrs,
+		slog.Int("status", sw.statusCode()),
+		slog.Bool("aborted", aborted),
+		slog.Int64("bytes", sw.bytes),
+		slog.String("backend", sw.Header().Get(backendHeader)),
+		slog.Float64("duration_seconds", duration.Seconds()),
+		slog.Float64("queue_wait_seconds", time.Duration(info.queueWait.Load()).Seconds()),
+		slog.Float64("backend_seconds", time.Duration(info.backend.Load()).Seconds()),
+	)
+	slog.LogAttrs(r.Context(), slog.LevelInfo, "access", attrs...)
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// sampleStream 为 vector 或 matrix 结果中的一条序列，样本保持原始 JSON
+type sampleStream struct {
+	Metric     map[string]string `json:"metric"`
+	Value      json.RawMessage   `json:"value,omitempty"`
+	Histogram  json.RawMessage   `json:"histogram,omitempty"`
+	Values     []json.RawMessage `json:"values,omitempty"`
+	Histograms []json.RawMessage `json:"histograms,omitempty"`
+}
+
+// mergeQueryData 合并多个后端的查询结果，标签集相同的序列只保留一条，matrix 的样本按时间戳合并。
+// vector 按后端顺序拼接以保留 sort()、topk() 等函数的顺序，matrix 按标签集排序
+func mergeQueryData(datas []*queryData) (*queryData, error) {
+	data, _, err := mergeSeries(datas)
+	return data, err
+}
+
+// mergeSeries 与 mergeQueryData 相同，同时返回在多个结果中重复出现的序列数
+func mergeSeries(datas []*queryData) (*queryData, int, error) {
+	if len(datas) == 0 {
+		return nil, 0, fmt.Errorf("no results to merge")
+	}
+
+	resultType := datas[0].ResultType
+	for _, d := range datas[1:] {
+		if d.ResultType != resultType {
+			return nil, 0, fmt.Errorf("cannot merge %s result with %s result", resultType, d.ResultType)
+		}
+	}
+
+	switch resultType {
+	case "vector", "matrix":
+	default:
+		// scalar 与 string 无法合并，取第一个结果，由调用方决定是否提示
+		return datas[0], 0, nil
+	}
+
+	var merged []*sampleStream
+	duplicates := 0
+	index := make(map[string]*sampleStream)
+	for _, d := range datas {
+		var streams []*sampleStream
+		err := json.Unmarshal(d.Result, &streams)
+		if err != nil {
+			return nil, 0, fmt.Errorf("decode %s result: %v", resultType, err)
+		}
+
+		for _, s := range streams {
+			key := labelsKey(s.Metric)
+			existing, ok := index[key]
+			if !ok {
+				index[key] = s
+				merged = append(merged, s)
+				continue
+			}
+			duplicates++
+			if resultType == "matrix" {
+				if existing.Values, err = mergePoints(existing.Values, s.Values); err != nil {
+					return nil, 0, err
+				}
+				if existing.Histograms, err = mergePoints(existing.Histograms, s.Histograms); err != nil {
+					return nil, 0, err
+				}
+			}
+		}
+	}
+
+	if resultType == "matrix" {
+		slices.SortFunc(merged, func(a, b *sampleStream) int {
+			return strings.Compare(labelsKey(a.Metric), labelsKey(b.Metric))
+		})
+	}
+
+	result, err := json.Marshal(merged)
+	if err != nil {
+		return nil, 0, err
+	}
+	return &queryData{ResultType: resultType, Result: result}, duplicates, nil
+}
+
+// mergePoints 按时间戳合并两组样本，时间戳相同时保留前者
+func mergePoints(a, b []json.RawMessage) ([]json.RawMessage, error) {
+	if len(b) == 0 {
+		return a, nil
+	}
+	if len(a) == 0 {
+		return b, nil
+	}
+
+	type point struct {
+		ts  float64
+		raw json.RawMessage
+	}
+	points := make([]point, 0, len(a)+len(b))
+	seen := make(map[float64]bool, len(a)+len(b))
+	for _, raw := range slices.Concat(a, b) {
+		ts, err := pointTimestamp(raw)
+		if err != nil {
+			return nil, err
+		}
+		if seen[ts] {
+			continue
+		}
+		seen[ts] = true
+		points = append(points, point{ts: ts, raw: raw})
+	}
+
+	slices.SortStableFunc(points, func(x, y point) int {
+		switch {
+		case x.ts < y.ts:
+			return -1
+		case x.ts > y.ts:
+			return 1
+		}
+		return 0
+	})
+
+	out := make([]json.RawMessage, len(points))
+	for i, p := range points {
+		out[i] = p.raw
+	}
+	return out, nil
+}
+
+// pointTimestamp 解析 [timestamp, value] 样本中的时间戳
+func pointTimestamp(raw json.RawMessage) (float64, error) {
+	var pair []json.RawMessage
+	if err := json.Unmarshal(raw, &pair); err != nil || len(pair) != 2 {
+		return 0, fmt.Errorf("invalid sample %s", raw)
+	}
+	return strconv.ParseFloat(string(pair[0]), 64)
+}
+
+func labelsKey(metric map[string]string) string {
+	names := make([]string, 0, len(metric))
+	for name := range metric {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString(name)
+		b.WriteByte('\xff')
+		b.WriteString(metric[name])
+		b.WriteByte('\xff')
+	}
+	return b.String()
+}
+
+// uniqueStrings 按出现顺序合并多个列表并去重，用于合并 warnings、infos 和后端列表
+func uniqueStrings(lists ...[]string) []string {
+	var warnings []string
+	for _, list := range lists {
+		for _, w := range list {
+			if !slices.Contains(warnings, w) {
+				warnings = append(warnings, w)
+			}
+		}
+	}
+	return warnings
+}
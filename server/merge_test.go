@@ -0,0 +1,71 @@
+package server
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMergeSeries(t *testing.T) {
+	tests := []struct {
+		name       string
+		resultType string
+		results    []string
+		want       string
+		duplicates int
+	}{
+		{
+			name:       "vector keeps backend order",
+			resultType: "vector",
+			results: []string{
+				`[{"metric":{"space":"b"},"value":[1,"3"]},{"metric":{"space":"a"},"value":[1,"2"]}]`,
+				`[{"metric":{"space":"c"},"value":[1,"1"]}]`,
+			},
+			want: `[{"metric":{"space":"b"},"value":[1,"3"]},{"metric":{"space":"a"},"value":[1,"2"]},{"metric":{"space":"c"},"value":[1,"1"]}]`,
+		},
+		{
+			name:       "vector aggregated on each backend",
+			resultType: "vector",
+			results:    []string{`[{"metric":{},"value":[1,"3"]}]`, `[{"metric":{},"value":[1,"4"]}]`},
+			want:       `[{"metric":{},"value":[1,"3"]}]`,
+			duplicates: 1,
+		},
+		{
+			name:       "matrix sorted by labels",
+			resultType: "matrix",
+			results: []string{
+				`[{"metric":{"space":"b"},"values":[[1,"1"]]}]`,
+				`[{"metric":{"space":"a"},"values":[[1,"2"]]}]`,
+			},
+			want: `[{"metric":{"space":"a"},"values":[[1,"2"]]},{"metric":{"space":"b"},"values":[[1,"1"]]}]`,
+		},
+		{
+			name:       "matrix points merged",
+			resultType: "matrix",
+			results: []string{
+				`[{"metric":{"space":"a"},"values":[[1,"1"],[3,"3"]]}]`,
+				`[{"metric":{"space":"a"},"values":[[2,"2"],[3,"4"]]}]`,
+			},
+			want:       `[{"metric":{"space":"a"},"values":[[1,"1"],[2,"2"],[3,"3"]]}]`,
+			duplicates: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var datas []*queryData
+			for _, result := range tt.results {
+				datas = append(datas, &queryData{ResultType: tt.resultType, Result: json.RawMessage(result)})
+			}
+			data, duplicates, err := mergeSeries(datas)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data.Result) != tt.want {
+				t.Errorf("got %s, want %s", data.Result, tt.want)
+			}
+			if duplicates != tt.duplicates {
+				t.Errorf("got %d duplicates, want %d", duplicates, tt.duplicates)
+			}
+		})
+	}
+}
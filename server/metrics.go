@@ -0,0 +1,139 @@
+package server
+
+import (
+	"runtime"
+	"runtime/debug"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// durationBuckets 覆盖从毫秒级的元数据请求到分钟级的范围查询
+var durationBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}
+
+var (
+	requests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "promproxy_requests_total",
+		Help: "Requests handled by the proxy, by endpoint class, status code and tenant.",
+	}, []string{"endpoint", "code", "tenant"})
+	requestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "promproxy_request_duration_seconds",
+		Help:    "Time taken to handle requests, by endpoint class and tenant.",
+		Buckets: durationBuckets,
+	}, []string{"endpoint", "tenant"})
+	rejectedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "promproxy_rejected_requests_total",
+		Help: "Policy violations that caused requests to be rejected, by middleware and rule.",
+	}, []string{"middleware", "rule"})
+	inflightRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promproxy_inflight_requests",
+		Help: "Requests holding a concurrency slot.",
+	})
+	queuedRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promproxy_queued_requests",
+		Help: "Requests waiting for a concurrency slot.",
+	})
+	maxConcurrency = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promproxy_max_concurrency",
+		Help: "Number of concurrency slots.",
+	})
+	backendRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "promproxy_backend_requests_total",
+		Help: "Requests sent to backends, by backend and status code (error for connection failures).",
+	}, []string{"backend", "code"})
+	backendRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "promproxy_backend_request_duration_seconds",
+		Help:    "Time until backends returned response headers, by backend.",
+		Buckets: durationBuckets,
+	}, []string{"backend"})
+	buildInfo = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "promproxy_build_info",
+		Help: "A metric with a constant '1' value labeled by version, revision and goversion from which promproxy was built.",
+	}, []string{"version", "revision", "goversion"})
+	resultsCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "promproxy_results_cache_requests_total",
+		Help: "Range queries served through the results cache, by result (hit, partial, miss).",
+	}, []string{"result"})
+	resultsCacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "promproxy_results_cache_evictions_total",
+		Help: "Entries evicted from the results cache.",
+	})
+	resultsCacheEntries = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promproxy_results_cache_entries",
+		Help: "Number of entries in the results cache.",
+	})
+	resultsCacheBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promproxy_results_cache_size_bytes",
+		Help: "Size of the results stored in the results cache.",
+	})
+	coalescedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "promproxy_coalesced_requests_total",
+		Help: "Requests that waited for an identical in-flight request, by result (shared saves a backend call, fallback does not).",
+	}, []string{"result"})
+	rateLimitedRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "promproxy_rate_limited_requests_total",
+		Help: "Requests rejected by the rate limiter, by limiter (tenant, client, endpoint).",
+	}, []string{"limiter"})
+	rateLimiterBuckets = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "promproxy_rate_limiter_buckets",
+		Help: "Number of active token buckets, by limiter (tenant, client, endpoint).",
+	}, []string{"limiter"})
+	backendRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "promproxy_backend_retries_total",
+		Help: "Requests retried after a connection error or a 502/503/504 response, by the backend that failed.",
+	}, []string{"backend"})
+	backendCircuitState = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "promproxy_backend_circuit_state",
+		Help: "State of the backend circuit breaker (0 closed, 1 open, 2 half-open).",
+	}, []string{"backend"})
+	configLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promproxy_config_last_reload_successful",
+		Help: "Whether the last configuration reload attempt was successful.",
+	})
+	configLastReloadSuccessTimestamp = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promproxy_config_last_reload_success_timestamp_seconds",
+		Help: "Timestamp of the last successful configuration reload.",
+	})
+	configHash = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "promproxy_config_hash",
+		Help: "Hash of the currently loaded configuration file.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		requests,
+		requestDuration,
+		rejectedRequests,
+		inflightRequests,
+		queuedRequests,
+		maxConcurrency,
+		backendRequests,
+		backendRequestDuration,
+		buildInfo,
+		resultsCacheRequests,
+		resultsCacheEvictions,
+		resultsCacheEntries,
+		resultsCacheBytes,
+		coalescedRequests,
+		rateLimitedRequests,
+		rateLimiterBuckets,
+		backendRetries,
+		backendCircuitState,
+		configLastReloadSuccessful,
+		configLastReloadSuccessTimestamp,
+		configHash,
+	)
+
+	version, revision := "unknown", "unknown"
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if info.Main.Version != "" {
+			version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				revision = setting.Value
+			}
+		}
+	}
+	buildInfo.WithLabelValues(version, revision, runtime.Version()).Set(1)
+}
@@ -1,12 +1,17 @@
 package server
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
-	"log"
+	"log/slog"
 	"net/http"
+	"net/http/httputil"
+	"net/url"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/prometheus/prometheus/promql/parser"
@@ -14,69 +19,134 @@ import (
 	"github.com/zhengtianbao/promproxy/middleware"
 )
 
+const costHeader = "X-Promproxy-Estimated-Samples"
+
 type ProxyServer struct {
-	config      *config.Config
-	middlewares []middleware.Middleware
-	semaphore   chan struct{}
-	client      *http.Client
+	config    *config.Config
+	pipeline  atomic.Pointer[Pipeline]
+	reloader  *reloader
+	scheduler *scheduler
+	limiter   *rateLimiter
+	transport http.RoundTripper
+	backends  *backendTransport
+	proxy     *httputil.ReverseProxy
+	router    *router
+	cache     *resultsCache
+	coalescer *coalescer
+	audit     *auditLog
+	draining  atomic.Bool
 }
 
-func NewProxyServer(config *config.Config) *ProxyServer {
+func NewProxyServer(config *config.Config) (*ProxyServer, error) {
+	transport, err := newClientTransport(config.Prometheus.Client)
+	if err != nil {
+		return nil, fmt.Errorf("invalid prometheus client config: %v", err)
+	}
+
 	server := &ProxyServer{
 		config:    config,
-		semaphore: make(chan struct{}, config.Server.MaxConcurrency),
-		client:    &http.Client{Timeout: 30 * time.Second},
+		transport: transport,
 	}
+	server.pipeline.Store(&Pipeline{Config: config, QueryParser: &middleware.QueryParser{}})
 
-	return server
+	router, err := newRouter(config.Prometheus, server.transport)
+	if err != nil {
+		return nil, err
+	}
+	server.router = router
+	server.backends = &backendTransport{next: server.transport, retry: config.Prometheus.Retry}
+	server.scheduler = newScheduler(config.Server, server.limitsFor)
+	if config.Cache.Enabled {
+		server.cache = newResultsCache(config.Cache)
+	}
+	if config.RateLimits.Enabled {
+		server.limiter = newRateLimiter(config.RateLimits, server.limitsFor)
+	}
+	if config.Coalescing.Enabled {
+		server.coalescer = newCoalescer(config.Coalescing)
+	}
+	if config.Audit.Enabled {
+		server.audit = newAuditLog(config.Audit, config.RateLimits.ClientIPHeader)
+	}
+	server.proxy = server.newReverseProxy()
+
+	return server, nil
 }
 
-func (p *ProxyServer) RegisterMiddlewares(middlewares ...middleware.Middleware) {
-	p.middlewares = append(p.middlewares, middlewares...)
+// SeriesCounter 返回通过后端池查询序列数的 SeriesCounter
+func (p *ProxyServer) SeriesCounter() middleware.SeriesCounter {
+	return &poolSeriesCounter{
+		router: p.router,
+		client: &http.Client{Transport: p.transport, Timeout: 10 * time.Second},
+	}
 }
 
-func (p *ProxyServer) processMiddlewares(ctx *middleware.RequestContext) error {
-	for _, middleware := range p.middlewares {
-		if err := middleware.Process(ctx); err != nil {
-			return err
+func (p *ProxyServer) processMiddlewares(pl *Pipeline, ctx *middleware.RequestContext) error {
+	err := middleware.Process(pl.Middlewares, ctx)
+	var violations middleware.Violations
+	if errors.As(err, &violations) {
+		for _, v := range violations {
+			rejectedRequests.WithLabelValues(v.Middleware, v.Rule).Inc()
 		}
 	}
-	return nil
+	return err
 }
 
-func (p *ProxyServer) proxyToPrometheus(w http.ResponseWriter, r *http.Request) error {
-	targetURL := p.config.Prometheus.URL + r.URL.Path
-	if r.URL.RawQuery != "" {
-		targetURL += "?" + r.URL.RawQuery
+func (p *ProxyServer) proxyToPrometheus(w http.ResponseWriter, r *http.Request, spaces []string) error {
+	pools := p.router.poolsFor(spaces)
+	fanout := len(pools) > 1
+	if fanout && (!p.config.Prometheus.Fanout.Enabled || !isQueryPath(r.URL.Path)) {
+		return fmt.Errorf("query spans spaces %v that are served by different backends", spaces)
 	}
 
-	proxyReq, err := http.NewRequest(r.Method, targetURL, r.Body)
+	limits := p.limitsFor(p.tenant(r))
+
+	req := r.Clone(r.Context())
+	timeout, err := clampTimeout(req, endpointTimeout(r.URL.Path, limits))
 	if err != nil {
-		return err
+		return fmt.Errorf("invalid timeout parameter: %v", err)
 	}
 
-	for key, values := range r.Header {
-		for _, value := range values {
-			proxyReq.Header.Add(key, value)
-		}
+	deadline := defaultBackendTimeout
+	if timeout > 0 {
+		deadline = timeout + backendTimeoutGrace
 	}
+	ctx, cancel := context.WithTimeout(r.Context(), deadline)
+	defer cancel()
+	ctx = context.WithValue(ctx, limitsContextKey{}, limits)
 
-	resp, err := p.client.Do(proxyReq)
-	if err != nil {
-		return err
+	if p.cache != nil && strings.HasSuffix(r.URL.Path, "/api/v1/query_range") &&
+		p.serveCachedRange(w, req.WithContext(ctx), pools, limits) {
+		return nil
 	}
-	defer resp.Body.Close()
 
-	for key, values := range resp.Header {
-		for _, value := range values {
-			w.Header().Add(key, value)
-		}
+	if p.config.Splitting.Enabled && strings.HasSuffix(r.URL.Path, "/api/v1/query_range") &&
+		p.serveSplitRange(w, req.WithContext(ctx), pools, limits) {
+		return nil
 	}
 
-	w.WriteHeader(resp.StatusCode)
+	if fanout {
+		return p.fanoutQuery(w, req.WithContext(ctx), pools, limits)
+	}
 
-	_, err = io.Copy(w, resp.Body)
-	return err
+	b, err := pools[0].pick()
+	if err != nil {
+		requestLogger(r.Context()).Error("Error proxying to Prometheus", "err", err)
+		writeAPIError(w, http.StatusServiceUnavailable, errorUnavailable, err.Error())
+		return nil
+	}
+	ctx = context.WithValue(ctx, backendContextKey{}, b)
+
+	b.inflight.Add(1)
+	defer b.inflight.Add(-1)
+
+	p.proxy.ServeHTTP(w, req.WithContext(ctx))
+	return nil
+}
+
+// tenant 返回请求头中的租户。取值由前置的认证代理负责设置，这里不做校验
+func (p *ProxyServer) tenant(r *http.Request) string {
+	return r.Header.Get(p.config.Server.TenantHeader)
 }
 
 func parseTimeParam(timeStr string) (time.Time, error) {
@@ -91,21 +161,25 @@ func parseTimeParam(timeStr string) (time.Time, error) {
 	return time.Time{}, fmt.Errorf("invalid time format")
 }
 
-func (p *ProxyServer) parseRequestContext(r *http.Request) (*middleware.RequestContext, error) {
-	ctx := &middleware.RequestContext{Request: r}
+// NewRequestContext 由请求参数构造中间件使用的 RequestContext，离线重放请求日志时也使用
+func (pl *Pipeline) NewRequestContext(r *http.Request, tenant string, query url.Values) (*middleware.RequestContext, error) {
+	ctx := &middleware.RequestContext{
+		Request: r,
+		Tenant:  tenant,
+	}
 
-	query := r.URL.Query()
 	ctx.Query = query.Get("query")
 
 	if ctx.Query == "" {
 		return nil, fmt.Errorf("missing query parameter")
 	}
 
-	expr, err := parser.ParseExpr(ctx.Query)
+	expr, err := pl.QueryParser.ParseExpr(ctx.Query)
 	if err != nil {
-		return nil, fmt.Errorf("invalid PromQL syntax: %v", err)
+		return nil, err
 	}
 	ctx.ParsedAST = expr
+	ctx.Spaces = middleware.ExprSpaces(expr)
 
 	path := strings.TrimPrefix(r.URL.Path, "/")
 	ctx.IsRange = strings.Contains(path, "query_range")
@@ -134,52 +208,151 @@ func (p *ProxyServer) parseRequestContext(r *http.Request) (*middleware.RequestC
 }
 
 func (p *ProxyServer) handleQuery(w http.ResponseWriter, r *http.Request) {
-	start := time.Now()
+	if p.coalescer == nil {
+		p.serveQuery(w, r)
+		return
+	}
 
-	select {
-	case p.semaphore <- struct{}{}:
-		defer func() {
-			<-p.semaphore
-			log.Printf("Processed request: Host: %s, Method: %s, Path: %s, Query: %s, duration: %s",
-				r.RemoteAddr, r.Method, r.URL.Path, r.URL.Query(), time.Since(start).String())
-		}()
-	case <-r.Context().Done():
-		http.Error(w, "Request cancelled", http.StatusRequestTimeout)
+	// 在占用并发槽位之前合并请求，等待中的 followers 不占用槽位
+	params, err := readForm(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errorBadData, err.Error())
+		return
+	}
+	p.coalescer.do(w, r, p.coalesceKey(r, params), p.serveQuery)
+}
+
+func (p *ProxyServer) serveQuery(w http.ResponseWriter, r *http.Request) {
+	logger := requestLogger(r.Context())
+
+	start := time.Now()
+	tenant := p.tenant(r)
+	err := p.scheduler.acquire(r.Context(), tenant)
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.queueWait.Add(int64(time.Since(start)))
+	}
+	if err != nil {
+		logger.Warn("Request rejected by scheduler", "tenant", tenant, "err", err)
+		writeSchedulerError(w, err, p.scheduler.retryAfter())
 		return
 	}
+	defer p.scheduler.release(tenant)
 
-	query := r.URL.Query()
+	query, err := readForm(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errorBadData, err.Error())
+		return
+	}
 
+	var spaces []string
 	if query.Get("query") != "" {
-		ctx, err := p.parseRequestContext(r)
+		pl := p.current()
+		ctx, err := pl.NewRequestContext(r, p.tenant(r), query)
 		if err != nil {
-			log.Printf("Parse request error: %v, query: %s", err, r.URL.Query().Get("query"))
-			http.Error(w, err.Error(), http.StatusBadRequest)
+			logger.Info("Parse request error", "query", query.Get("query"), "err", err)
+			writeAPIError(w, http.StatusBadRequest, errorBadData, err.Error())
 			return
 		}
 
-		if err := p.processMiddlewares(ctx); err != nil {
-			log.Printf("Validation error: %v, query: %s", err, ctx.Query)
-			http.Error(w, err.Error(), http.StatusBadRequest)
+		err = p.processMiddlewares(pl, ctx)
+		if ctx.Cost != nil {
+			w.Header().Set(costHeader, strconv.FormatInt(ctx.Cost.Samples, 10))
+		}
+		if info := requestInfoFrom(r.Context()); info != nil {
+			info.spaces = ctx.Spaces
+			errors.As(err, &info.violations)
+		}
+		if err != nil {
+			logger.Info("Validation error", "query", ctx.Query, "err", err)
+			writeValidationError(w, err)
 			return
 		}
+		spaces = ctx.Spaces
+	}
+	if err := p.proxyToPrometheus(w, r, spaces); err != nil {
+		logger.Error("Error proxying to Prometheus", "err", err)
+		writeAPIError(w, http.StatusBadRequest, errorBadData, err.Error())
+		return
+	}
+}
+
+func (p *ProxyServer) handleQueryCost(w http.ResponseWriter, r *http.Request) {
+	pl := p.current()
+	if pl.CostEstimator == nil {
+		writeAPIError(w, http.StatusNotFound, errorNotFound, "query cost estimation is not enabled")
+		return
+	}
+
+	query, err := readForm(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errorBadData, err.Error())
+		return
+	}
+
+	ctx, err := pl.NewRequestContext(r, p.tenant(r), query)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errorBadData, err.Error())
+		return
+	}
+	ctx.IsRange = ctx.Step != ""
+
+	// 只为通过访问策略校验的查询估算成本，避免泄露未授权 space 的序列数
+	err = middleware.Process(middleware.Offline(pl.Middlewares), ctx)
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.spaces = ctx.Spaces
+		errors.As(err, &info.violations)
+	}
+	if err != nil {
+		requestLogger(r.Context()).Info("Validation error", "query", ctx.Query, "err", err)
+		writeValidationError(w, err)
+		return
 	}
-	if err := p.proxyToPrometheus(w, r); err != nil {
-		log.Printf("Error proxying to Prometheus: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+
+	budget := pl.Config.LimitsFor(ctx.Tenant).MaxSamples
+	estimate, err := pl.CostEstimator.Estimate(ctx, 0)
+	if err != nil {
+		requestLogger(r.Context()).Error("Cost estimation error", "query", ctx.Query, "err", err)
+		writeAPIError(w, http.StatusBadGateway, errorUnavailable, err.Error())
 		return
 	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(costHeader, strconv.FormatInt(estimate.Samples, 10))
+	json.NewEncoder(w).Encode(map[string]any{
+		"status": "success",
+		"data": map[string]any{
+			"tenant":   ctx.Tenant,
+			"budget":   budget,
+			"allowed":  budget <= 0 || estimate.Samples <= budget,
+			"estimate": estimate,
+		},
+	})
 }
 
 func (p *ProxyServer) defaultProxyHandler(w http.ResponseWriter, r *http.Request) {
-	if err := p.proxyToPrometheus(w, r); err != nil {
-		log.Printf("Error proxying to Prometheus: %v", err)
-		http.Error(w, "Internal server error", http.StatusInternalServerError)
+	params, err := readForm(r)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errorBadData, err.Error())
+		return
+	}
+	spaces, err := requestSpaces(params)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, errorBadData, err.Error())
+		return
+	}
+	if info := requestInfoFrom(r.Context()); info != nil {
+		info.spaces = spaces
+	}
+
+	if err := p.proxyToPrometheus(w, r, spaces); err != nil {
+		requestLogger(r.Context()).Error("Error proxying to Prometheus", "err", err)
+		writeAPIError(w, http.StatusBadRequest, errorBadData, err.Error())
 		return
 	}
 }
 
-func (p *ProxyServer) Start() error {
+// Start 启动代理服务，ctx 结束后优雅退出
+func (p *ProxyServer) Start(ctx context.Context) error {
 	mux := http.NewServeMux()
 
 	mux.HandleFunc("/api/v1/query", p.handleQuery)
@@ -187,23 +360,27 @@ func (p *ProxyServer) Start() error {
 	mux.HandleFunc("/select/0/prometheus/api/v1/query", p.handleQuery)
 	mux.HandleFunc("/select/0/prometheus/api/v1/query_range", p.handleQuery)
 
+	mux.HandleFunc("/api/v1/query_cost", p.handleQueryCost)
+	mux.HandleFunc("/select/0/prometheus/api/v1/query_cost", p.handleQueryCost)
+
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		w.Write([]byte("OK"))
 	})
+	mux.HandleFunc("/-/ready", p.handleReady)
 
 	mux.HandleFunc("/", p.defaultProxyHandler)
 
 	mux.HandleFunc("/debug/parse", func(w http.ResponseWriter, r *http.Request) {
 		query := r.URL.Query().Get("query")
 		if query == "" {
-			http.Error(w, "missing query parameter", http.StatusBadRequest)
+			writeAPIError(w, http.StatusBadRequest, errorBadData, "missing query parameter")
 			return
 		}
 
-		expr, err := parser.ParseExpr(query)
+		expr, err := p.current().QueryParser.ParseExpr(query)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("parse error: %v", err), http.StatusBadRequest)
+			writeAPIError(w, http.StatusBadRequest, errorBadData, err.Error())
 			return
 		}
 
@@ -216,12 +393,62 @@ func (p *ProxyServer) Start() error {
 	})
 
 	addr := fmt.Sprintf(":%d", p.config.Server.Port)
-	log.Printf("Starting PromQL proxy server on %s", addr)
-	log.Printf("Max concurrency: %d", p.config.Server.MaxConcurrency)
-	log.Printf("Prometheus backend: %s", p.config.Prometheus.URL)
-	log.Printf("Allowed spaces: %v", p.config.Rules.AllowedSpaces)
+	slog.Info("Starting PromQL proxy server", "addr", addr, "max_concurrency", p.config.Server.MaxConcurrency)
+	slog.Info("Prometheus backends", "endpoints", p.config.Prometheus.BackendURLs(), "strategy", p.router.defaultPool.strategy)
+	for _, route := range p.config.Prometheus.Routes {
+		slog.Info("Route spaces to backends", "spaces", route.Spaces, "endpoints", route.Endpoints)
+	}
+	slog.Info("Allowed spaces", "spaces", p.config.Rules.AllowedSpaces)
+
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	for _, pool := range p.router.pools {
+		go pool.runHealthChecks(bgCtx)
+	}
+	go p.watchConfig(bgCtx)
 
-	return http.ListenAndServe(addr, mux)
+	// 管理接口在配置了 admin_port 时使用单独的监听端口
+	admin := mux
+	if p.config.Server.AdminPort != 0 {
+		admin = http.NewServeMux()
+	}
+	admin.HandleFunc("/metrics", handleMetrics)
+	admin.HandleFunc("/-/reload", p.handleReload)
+
+	srv := &http.Server{Addr: addr, Handler: p.instrument(p.rateLimit(mux))}
+	errCh := make(chan error, 2)
+	go func() {
+		errCh <- srv.ListenAndServe()
+	}()
+
+	var adminSrv *http.Server
+	if admin != mux {
+		adminSrv = &http.Server{Addr: fmt.Sprintf(":%d", p.config.Server.AdminPort), Handler: admin}
+		slog.Info("Starting admin server", "addr", adminSrv.Addr)
+		go func() {
+			errCh <- adminSrv.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		srv.Close()
+		if adminSrv != nil {
+			adminSrv.Close()
+		}
+		return err
+	case <-ctx.Done():
+	}
+
+	// 管理端口在排空期间保持可用，便于观察退出过程
+	err := p.shutdown(srv)
+	if adminSrv != nil {
+		adminSrv.Close()
+	}
+	if p.audit != nil {
+		p.audit.close()
+	}
+	return err
 }
 
 func printExpressionTree(w http.ResponseWriter, expr parser.Expr, depth int) {
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/zhengtianbao/promproxy/config"
+)
+
+// apiResponse 为 Prometheus 查询接口的响应
+type apiResponse struct {
+	Status    string     `json:"status"`
+	Data      *queryData `json:"data,omitempty"`
+	ErrorType string     `json:"errorType,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Warnings  []string   `json:"warnings,omitempty"`
+	Infos     []string   `json:"infos,omitempty"`
+}
+
+type queryData struct {
+	ResultType string          `json:"resultType"`
+	Result     json.RawMessage `json:"result"`
+}
+
+// backendError 为后端返回的错误响应
+type backendError struct {
+	backend    string
+	statusCode int
+	errorType  string
+	msg        string
+}
+
+func (e *backendError) Error() string {
+	return fmt.Sprintf("backend %s returned %d: %s", e.backend, e.statusCode, e.msg)
+}
+
+// queryBackend 向后端发送查询请求并解析响应，不把结果写回客户端；请求重试后实际返回响应的后端可能不是 b
+func (p *ProxyServer) queryBackend(ctx context.Context, b *backend, path string, params url.Values, header http.Header, limits config.LimitsConfig) (*apiResponse, *backend, error) {
+	body := params.Encode()
+	ctx = context.WithValue(ctx, backendContextKey{}, b)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, b.url.JoinPath(path).String(), strings.NewReader(body))
+	if err != nil {
+		return nil, b, err
+	}
+
+	req.Header = header.Clone()
+	filterHeaders(req.Header, p.config.Prometheus.Forward.RequestHeaders)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Del("Content-Length")
+	req.Header.Del("Accept-Encoding")
+
+	b.inflight.Add(1)
+	defer b.inflight.Add(-1)
+
+	resp, err := p.backends.RoundTrip(req)
+	if err != nil {
+		return nil, b, err
+	}
+	defer resp.Body.Close()
+	b = resp.Request.Context().Value(backendContextKey{}).(*backend)
+
+	if limits.MaxResponseBytes > 0 && resp.ContentLength > limits.MaxResponseBytes {
+		return nil, b, &responseLimitError{msg: fmt.Sprintf("response size %d bytes exceeds the limit of %d bytes",
+			resp.ContentLength, limits.MaxResponseBytes)}
+	}
+	data, err := io.ReadAll(newLimitedBody(resp.Body, limits.MaxResponseBytes, limits.MaxResponseSeries))
+	if err != nil {
+		return nil, b, err
+	}
+
+	var result apiResponse
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, b, fmt.Errorf("backend %s returned invalid response (status %d): %v", b.url.Host, resp.StatusCode, err)
+	}
+	if result.Status != "success" {
+		return nil, b, &backendError{
+			backend:    b.url.Host,
+			statusCode: resp.StatusCode,
+			errorType:  result.ErrorType,
+			msg:        result.Error,
+		}
+	}
+
+	return &result, b, nil
+}
+
+func writeAPIResponse(w http.ResponseWriter, resp *apiResponse) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// isQueryPath 判断是否为即时查询或范围查询接口
+func isQueryPath(path string) bool {
+	return strings.HasSuffix(path, "/api/v1/query") || strings.HasSuffix(path, "/api/v1/query_range")
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhengtianbao/promproxy/config"
+)
+
+const (
+	limiterTenant   = "tenant"
+	limiterClient   = "client"
+	limiterEndpoint = "endpoint"
+)
+
+// 令牌桶回满后即可删除，每隔 bucketSweepInterval 清理一次，避免按客户端 IP 的桶无限增长
+const bucketSweepInterval = time.Minute
+
+type bucketKey struct {
+	limiter string
+	key     string
+}
+
+type tokenBucket struct {
+	limit  config.RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func burstOf(limit config.RateLimit) float64 {
+	if limit.Burst > 0 {
+		return float64(limit.Burst)
+	}
+	return max(1, math.Ceil(limit.Rate))
+}
+
+func (b *tokenBucket) refill(now time.Time, limit config.RateLimit) {
+	b.limit = limit
+	b.tokens = min(burstOf(limit), b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+}
+
+// wait 返回桶中攒够一个令牌还需等待的时间
+func (b *tokenBucket) wait() time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / b.limit.Rate * float64(time.Second))
+}
+
+// rateLimiter 按租户、客户端 IP 和接口类别分别维护令牌桶，请求需要同时通过所有适用的桶
+type rateLimiter struct {
+	config config.RateLimitsConfig
+	limits func(tenant string) config.LimitsConfig
+
+	mu        sync.Mutex
+	buckets   map[bucketKey]*tokenBucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(cfg config.RateLimitsConfig, limits func(tenant string) config.LimitsConfig) *rateLimiter {
+	return &rateLimiter{
+		config:    cfg,
+		limits:    limits,
+		buckets:   make(map[bucketKey]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// allow 检查请求是否超出限速；超出时返回需要等待的时间和触发的限速类别
+func (l *rateLimiter) allow(r *http.Request, tenant string) (time.Duration, string, bool) {
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	checks := map[bucketKey]config.RateLimit{
+		{limiterTenant, tenant}:                               l.limits(tenant).RateLimit,
+		{limiterClient, clientIP(r, l.config.ClientIPHeader)}: l.config.PerClient,
+		{limiterEndpoint, endpointClass(r.URL.Path)}:          l.config.Endpoints[endpointClass(r.URL.Path)],
+	}
+
+	var wait time.Duration
+	var limited string
+	buckets := make([]*tokenBucket, 0, len(checks))
+	for key, limit := range checks {
+		if limit.Rate <= 0 {
+			continue
+		}
+		b, ok := l.buckets[key]
+		if !ok {
+			b = &tokenBucket{tokens: burstOf(limit), last: now}
+			l.buckets[key] = b
+			rateLimiterBuckets.WithLabelValues(key.limiter).Inc()
+		}
+		b.refill(now, limit)
+		if d := b.wait(); d > 0 && d >= wait {
+			wait, limited = d, key.limiter
+		}
+		buckets = append(buckets, b)
+	}
+
+	if limited != "" {
+		rateLimitedRequests.WithLabelValues(limited).Inc()
+		return wait, limited, false
+	}
+	for _, b := range buckets {
+		b.tokens--
+	}
+	return 0, "", true
+}
+
+// setConfig 替换限速阈值，已有令牌桶在下次使用时按新阈值补充令牌
+func (l *rateLimiter) setConfig(cfg config.RateLimitsConfig) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.config = cfg
+}
+
+func (l *rateLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < bucketSweepInterval {
+		return
+	}
+	l.lastSweep = now
+
+	for key, b := range l.buckets {
+		b.refill(now, b.limit)
+		if b.tokens >= burstOf(b.limit) {
+			delete(l.buckets, key)
+			rateLimiterBuckets.WithLabelValues(key.limiter).Dec()
+		}
+	}
+}
+
+// clientIP 从 header 的第一个地址识别客户端，header 为空或请求中没有该请求头时使用连接的远端地址
+func clientIP(r *http.Request, header string) string {
+	if header != "" {
+		if value := r.Header.Get(header); value != "" {
+			ip, _, _ := strings.Cut(value, ",")
+			return strings.TrimSpace(ip)
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// endpointClass 把请求路径归类为 query、query_range、metadata 或 other
+func endpointClass(path string) string {
+	switch {
+	case strings.HasSuffix(path, "/api/v1/query"):
+		return "query"
+	case strings.HasSuffix(path, "/api/v1/query_range"):
+		return "query_range"
+	case strings.HasSuffix(path, "/api/v1/series"), strings.HasSuffix(path, "/api/v1/labels"),
+		strings.HasSuffix(path, "/api/v1/metadata"), strings.Contains(path, "/api/v1/label/"):
+		return "metadata"
+	default:
+		return "other"
+	}
+}
+
+// rateLimit 在请求进入排队和校验之前执行限速
+func (p *ProxyServer) rateLimit(next http.Handler) http.Handler {
+	if p.limiter == nil {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/health" || r.URL.Path == "/-/ready" || r.URL.Path == "/metrics" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		tenant := p.tenant(r)
+		if wait, limiter, ok := p.limiter.allow(r, tenant); !ok {
+			requestLogger(r.Context()).Info("Request rate limited", "limiter", limiter, "remote_addr", r.RemoteAddr, "path", r.URL.Path, "tenant", tenant)
+			w.Header().Set("Retry-After", strconv.Itoa(max(1, int(math.Ceil(wait.Seconds())))))
+			writeAPIError(w, http.StatusTooManyRequests, errorUnavailable, fmt.Sprintf("%s rate limit exceeded", limiter))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,209 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zhengtianbao/promproxy/config"
+	"github.com/zhengtianbao/promproxy/middleware"
+)
+
+// Pipeline 为可以热加载的查询处理配置，热加载时整体原子替换，正在处理的请求继续使用旧配置
+type Pipeline struct {
+	Config        *config.Config
+	QueryParser   *middleware.QueryParser
+	Middlewares   []middleware.Middleware
+	CostEstimator *middleware.CostEstimator
+}
+
+// PipelineBuilder 按配置创建查询处理配置
+type PipelineBuilder func(cfg *config.Config) (*Pipeline, error)
+
+// SetPipeline 原子替换查询处理配置
+func (p *ProxyServer) SetPipeline(pl *Pipeline) {
+	p.pipeline.Store(pl)
+	if p.limiter != nil {
+		p.limiter.setConfig(pl.Config.RateLimits)
+	}
+}
+
+func (p *ProxyServer) current() *Pipeline {
+	return p.pipeline.Load()
+}
+
+// limitsFor 返回租户在当前配置下生效的限额
+func (p *ProxyServer) limitsFor(tenant string) config.LimitsConfig {
+	return p.current().Config.LimitsFor(tenant)
+}
+
+type reloader struct {
+	file  string
+	build PipelineBuilder
+	token *secret
+
+	mu       sync.Mutex
+	attempts [sha256.Size]byte
+}
+
+// EnableReload 允许通过 Reload、/-/reload 接口和配置文件变化重新加载 file 中的配置
+func (p *ProxyServer) EnableReload(file string, build PipelineBuilder) error {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	reload := p.config.Server.Reload
+	p.reloader = &reloader{file: file, build: build, attempts: sha256.Sum256(data)}
+	if reload.AuthToken != "" || reload.AuthTokenFile != "" {
+		p.reloader.token = newSecret(reload.AuthToken, reload.AuthTokenFile)
+	}
+	recordReload(p.reloader.attempts, nil)
+	return nil
+}
+
+// Reload 重新读取并校验配置文件，成功后原子替换查询处理配置，失败时保留当前配置
+func (p *ProxyServer) Reload() error {
+	return p.reload(false)
+}
+
+func (p *ProxyServer) reload(onlyIfChanged bool) error {
+	r := p.reloader
+	if r == nil {
+		return errors.New("configuration reload is not enabled")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	data, err := os.ReadFile(r.file)
+	if err != nil {
+		slog.Error("Configuration reload failed", "file", r.file, "err", err)
+		recordReload(r.attempts, err)
+		return err
+	}
+	hash := sha256.Sum256(data)
+	// 文件内容没有变化时不重复加载，加载失败的内容也不会反复重试
+	if onlyIfChanged && hash == r.attempts {
+		return nil
+	}
+	r.attempts = hash
+
+	cfg, err := config.Load(data)
+	if err != nil {
+		err = fmt.Errorf("invalid configuration: %v", err)
+	} else {
+		var pl *Pipeline
+		if pl, err = r.build(cfg); err == nil {
+			warnRestartRequired(p.config, cfg)
+			p.SetPipeline(pl)
+		}
+	}
+
+	recordReload(hash, err)
+	if err != nil {
+		slog.Error("Configuration reload failed, keeping the current configuration", "file", r.file, "err", err)
+		return err
+	}
+	slog.Info("Configuration reloaded", "file", r.file, "sha256", fmt.Sprintf("%x", hash))
+	return nil
+}
+
+// warnRestartRequired 记录热加载不会生效、需要重启的配置修改
+func warnRestartRequired(running, loaded *config.Config) {
+	sections := []struct {
+		name            string
+		running, loaded any
+	}{
+		{"server", running.Server, loaded.Server},
+		{"prometheus", running.Prometheus, loaded.Prometheus},
+		{"results_cache", running.Cache, loaded.Cache},
+		{"query_splitting", running.Splitting, loaded.Splitting},
+		{"coalescing", running.Coalescing, loaded.Coalescing},
+		{"rate_limits.enabled", running.RateLimits.Enabled, loaded.RateLimits.Enabled},
+		{"logging", running.Logging, loaded.Logging},
+		{"audit", running.Audit, loaded.Audit},
+	}
+
+	var changed []string
+	for _, section := range sections {
+		if !reflect.DeepEqual(section.running, section.loaded) {
+			changed = append(changed, section.name)
+		}
+	}
+	if len(changed) > 0 {
+		slog.Warn("Configuration changes require a restart and were not applied", "sections", strings.Join(changed, ", "))
+	}
+}
+
+func recordReload(hash [sha256.Size]byte, err error) {
+	if err != nil {
+		configLastReloadSuccessful.Set(0)
+		return
+	}
+	configLastReloadSuccessful.Set(1)
+	configLastReloadSuccessTimestamp.SetToCurrentTime()
+	// 只取前 6 字节，保证 float64 能精确表示
+	configHash.Set(float64(binary.BigEndian.Uint64(hash[:8]) >> 16))
+}
+
+// watchConfig 周期性检查配置文件，内容变化时重新加载
+func (p *ProxyServer) watchConfig(ctx context.Context) {
+	interval := p.config.Server.Reload.WatchInterval
+	if p.reloader == nil || interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.reload(true)
+		}
+	}
+}
+
+// handleReload 处理 POST /-/reload，需要携带配置的 auth_token 作为 Bearer token
+func (p *ProxyServer) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeAPIError(w, http.StatusMethodNotAllowed, errorBadData, "reload requires a POST request")
+		return
+	}
+	if p.reloader == nil || p.reloader.token == nil {
+		writeAPIError(w, http.StatusForbidden, errorBadData, "reload endpoint is disabled, configure server.reload.auth_token to enable it")
+		return
+	}
+
+	token, err := p.reloader.token.get()
+	if err != nil {
+		slog.Error("Unable to read reload auth token", "err", err)
+		writeAPIError(w, http.StatusInternalServerError, errorInternal, "unable to read reload auth token")
+		return
+	}
+	provided, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+		writeAPIError(w, http.StatusUnauthorized, errorBadData, "invalid reload auth token")
+		return
+	}
+
+	if err := p.Reload(); err != nil {
+		writeAPIError(w, http.StatusBadRequest, errorBadData, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"success"}` + "\n"))
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zhengtianbao/promproxy/config"
+)
+
+// backendTransport 记录每次转发的结果用于被动健康检查和熔断，
+// 并对幂等请求在连接错误和 502/503/504 时重新选择后端重试，Prometheus 查询超时返回的 503 除外
+type backendTransport struct {
+	next  http.RoundTripper
+	retry config.RetryConfig
+}
+
+func (t *backendTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b, ok := req.Context().Value(backendContextKey{}).(*backend)
+	if !ok {
+		return t.next.RoundTrip(req)
+	}
+
+	attempts := 1
+	if isIdempotent(req) {
+		attempts = max(1, t.retry.MaxAttempts)
+	}
+
+	// 重试需要重新发送请求体，幂等请求的请求体都是较小的查询表单
+	var body []byte
+	if attempts > 1 && req.Body != nil && req.Body != http.NoBody {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for attempt := 1; ; attempt++ {
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+
+		start := time.Now()
+		resp, err := t.next.RoundTrip(req)
+		if err != nil && req.Context().Err() != nil {
+			// 客户端取消或超时不代表后端故障
+			return nil, err
+		}
+		recordAttempt(req, b, resp, err, time.Since(start))
+		failed := err != nil || isBackendFailure(resp)
+		b.pool.observe(b, failed)
+		if !failed || attempt >= attempts {
+			return resp, err
+		}
+
+		next, pickErr := b.pool.pick()
+		if pickErr != nil {
+			return resp, err
+		}
+
+		if err == nil {
+			requestLogger(req.Context()).Warn("Retrying request after backend failure", "path", req.URL.Path, "backend", b.url.Host, "status", resp.StatusCode, "attempt", attempt, "max_attempts", attempts)
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+		} else {
+			requestLogger(req.Context()).Warn("Retrying request after backend failure", "path", req.URL.Path, "backend", b.url.Host, "err", err, "attempt", attempt, "max_attempts", attempts)
+		}
+		backendRetries.WithLabelValues(b.url.Host).Inc()
+
+		timer := time.NewTimer(t.backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		}
+
+		req = retarget(req, b, next)
+		b = next
+	}
+}
+
+// recordAttempt 记录一次转发的耗时和结果
+func recordAttempt(req *http.Request, b *backend, resp *http.Response, err error, elapsed time.Duration) {
+	code := "error"
+	if err == nil {
+		code = strconv.Itoa(resp.StatusCode)
+	}
+	backendRequests.WithLabelValues(b.url.Host, code).Inc()
+	backendRequestDuration.WithLabelValues(b.url.Host).Observe(elapsed.Seconds())
+
+	if info := requestInfoFrom(req.Context()); info != nil {
+		info.backend.Add(int64(elapsed))
+		if err == nil {
+			info.backendStatus.Store(int32(resp.StatusCode))
+		}
+	}
+}
+
+// backoff 返回第 attempt 次失败后的等待时间，在指数退避的基础上加入随机抖动
+func (t *backendTransport) backoff(attempt int) time.Duration {
+	d := t.retry.InitialBackoff << (attempt - 1)
+	if d <= 0 || d > t.retry.MaxBackoff {
+		d = t.retry.MaxBackoff
+	}
+	return d/2 + rand.N(d/2+1)
+}
+
+// retarget 把发往 from 的请求改为发往 to，并在 context 中记录新的后端
+func retarget(req *http.Request, from, to *backend) *http.Request {
+	if from == to {
+		return req
+	}
+
+	out := req.WithContext(context.WithValue(req.Context(), backendContextKey{}, to))
+	u := *req.URL
+	u.Scheme = to.url.Scheme
+	u.Host = to.url.Host
+	u.Path = to.url.JoinPath(strings.TrimPrefix(req.URL.Path, from.url.Path)).Path
+	u.RawPath = ""
+	out.URL = &u
+	// Host 为空时使用新后端 URL 中的 host，否则会沿用发往原后端的 Host 头
+	out.Host = ""
+	return out
+}
+
+// isIdempotent 判断请求是否可以安全重试：GET/HEAD 请求以及通过 POST 发送的查询和元数据请求
+func isIdempotent(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		return true
+	case http.MethodPost:
+		class := endpointClass(req.URL.Path)
+		return class == "query" || class == "query_range" || class == "metadata"
+	}
+	return false
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestRetarget(t *testing.T) {
+	newBackend := func(raw string) *backend {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &backend{url: u}
+	}
+	from := newBackend("http://prom-a:9090/prometheus")
+	to := newBackend("https://prom-b.example.com/")
+
+	req, err := http.NewRequest(http.MethodPost, from.url.JoinPath("/api/v1/query").String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := retarget(req, from, to)
+
+	if got, want := out.URL.String(), "https://prom-b.example.com/api/v1/query"; got != want {
+		t.Errorf("got URL %s, want %s", got, want)
+	}
+	if out.Host != "" {
+		t.Errorf("got Host %q, want the host of the new URL", out.Host)
+	}
+	if b, _ := out.Context().Value(backendContextKey{}).(*backend); b != to {
+		t.Error("backend in the request context was not updated")
+	}
+	if req.Host != "prom-a:9090" {
+		t.Errorf("original request was modified, Host %q", req.Host)
+	}
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/zhengtianbao/promproxy/config"
+	"github.com/zhengtianbao/promproxy/middleware"
+)
+
+// router 按 space 把请求路由到对应的后端池，未配置路由的 space 使用默认后端池
+type router struct {
+	defaultPool *backendPool
+	spacePools  map[string]*backendPool
+	pools       []*backendPool
+}
+
+func newRouter(cfg config.PrometheusConfig, transport http.RoundTripper) (*router, error) {
+	defaultPool, err := newBackendPool(cfg, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &router{
+		defaultPool: defaultPool,
+		spacePools:  make(map[string]*backendPool),
+		pools:       []*backendPool{defaultPool},
+	}
+
+	for i, route := range cfg.Routes {
+		routeCfg := cfg
+		routeCfg.URL = ""
+		routeCfg.Endpoints = route.Endpoints
+		if route.Strategy != "" {
+			routeCfg.Strategy = route.Strategy
+		}
+
+		pool, err := newBackendPool(routeCfg, transport)
+		if err != nil {
+			return nil, fmt.Errorf("route %d: %v", i, err)
+		}
+		for _, space := range route.Spaces {
+			if _, ok := r.spacePools[space]; ok {
+				return nil, fmt.Errorf("route %d: space %q is already routed", i, space)
+			}
+			r.spacePools[space] = pool
+		}
+		r.pools = append(r.pools, pool)
+	}
+
+	return r, nil
+}
+
+// poolFor 返回能服务所有 space 的后端池，space 分布在不同后端时返回错误
+func (r *router) poolFor(spaces []string) (*backendPool, error) {
+	pools := r.poolsFor(spaces)
+	if len(pools) > 1 {
+		return nil, fmt.Errorf("query spans spaces %v that are served by different backends", spaces)
+	}
+	return pools[0], nil
+}
+
+// poolsFor 返回服务这些 space 的所有后端池，没有 space 时使用默认后端池
+func (r *router) poolsFor(spaces []string) []*backendPool {
+	var pools []*backendPool
+	for _, space := range spaces {
+		if pool := r.poolForSpace(space); !slices.Contains(pools, pool) {
+			pools = append(pools, pool)
+		}
+	}
+
+	if len(pools) == 0 {
+		return []*backendPool{r.defaultPool}
+	}
+	return pools
+}
+
+func (r *router) poolForSpace(space string) *backendPool {
+	if pool, ok := r.spacePools[space]; ok {
+		return pool
+	}
+	return r.defaultPool
+}
+
+// requestSpaces 从元数据接口的 match[] 参数中提取 space
+func requestSpaces(params url.Values) ([]string, error) {
+	var spaces []string
+	for _, selector := range params["match[]"] {
+		matchers, err := parser.ParseMetricSelector(selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid match[] selector %q: %v", selector, err)
+		}
+		spaces = append(spaces, middleware.MatcherSpaces(matchers)...)
+	}
+
+	slices.Sort(spaces)
+	return slices.Compact(spaces), nil
+}
+
+// selectorSpaces 返回 series API 选择器中的 space，解析失败时返回空
+func selectorSpaces(selector string) []string {
+	matchers, err := parser.ParseMetricSelector(selector)
+	if err != nil {
+		return nil
+	}
+	return middleware.MatcherSpaces(matchers)
+}
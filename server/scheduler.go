@@ -0,0 +1,205 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/zhengtianbao/promproxy/config"
+)
+
+var (
+	errQueueFull    = errors.New("too many queued requests for tenant")
+	errQueueTimeout = errors.New("timed out waiting in the request queue")
+)
+
+type waiter struct {
+	ready   chan struct{}
+	granted bool
+}
+
+type tenantQueue struct {
+	name     string
+	waiters  *list.List
+	inflight int
+	// vtime 为加权公平调度的虚拟时间，每次出队增加 1/weight
+	vtime float64
+}
+
+// scheduler 按租户排队并加权公平地分配并发槽位
+type scheduler struct {
+	capacity       int
+	maxQueueLength int
+	maxQueueWait   time.Duration
+	limits         func(tenant string) config.LimitsConfig
+
+	mu       sync.Mutex
+	inflight int
+	queued   int
+	vtime    float64
+	tenants  map[string]*tenantQueue
+}
+
+func newScheduler(cfg config.ServerConfig, limits func(tenant string) config.LimitsConfig) *scheduler {
+	maxConcurrency.Set(float64(cfg.MaxConcurrency))
+	return &scheduler{
+		capacity:       cfg.MaxConcurrency,
+		maxQueueLength: cfg.MaxQueueLength,
+		maxQueueWait:   cfg.MaxQueueWait,
+		limits:         limits,
+		tenants:        make(map[string]*tenantQueue),
+	}
+}
+
+// acquire 为租户排队等待一个并发槽位，队列已满或等待超时时返回错误
+func (s *scheduler) acquire(ctx context.Context, tenant string) error {
+	s.mu.Lock()
+	q := s.queue(tenant)
+	if s.maxQueueLength > 0 && q.waiters.Len() >= s.maxQueueLength {
+		s.mu.Unlock()
+		return errQueueFull
+	}
+
+	// 新进入排队的租户不能使用空闲期间积累的份额
+	if q.waiters.Len() == 0 && q.inflight == 0 {
+		q.vtime = max(q.vtime, s.vtime)
+	}
+
+	w := &waiter{ready: make(chan struct{})}
+	elem := q.waiters.PushBack(w)
+	s.queued++
+	s.dispatch()
+	s.report()
+	s.mu.Unlock()
+
+	var timeout <-chan time.Time
+	if s.maxQueueWait > 0 {
+		timer := time.NewTimer(s.maxQueueWait)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+
+	var err error
+	select {
+	case <-w.ready:
+		return nil
+	case <-timeout:
+		err = errQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if w.granted {
+		// 超时与分配同时发生，槽位已经属于该请求
+		return nil
+	}
+	q.waiters.Remove(elem)
+	s.queued--
+	s.cleanup(q)
+	s.report()
+	return err
+}
+
+// tryAcquire 在没有排队请求且有空闲槽位时立即占用一个槽位
+func (s *scheduler) tryAcquire(tenant string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.queue(tenant)
+	if s.queued > 0 || s.inflight >= s.capacity || !s.eligible(q) {
+		s.cleanup(q)
+		return false
+	}
+	s.inflight++
+	q.inflight++
+	s.report()
+	return true
+}
+
+func (s *scheduler) release(tenant string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	q := s.queue(tenant)
+	s.inflight--
+	q.inflight--
+	s.dispatch()
+	s.cleanup(q)
+	s.report()
+}
+
+// dispatch 把空闲槽位依次分配给虚拟时间最小的可运行租户
+func (s *scheduler) dispatch() {
+	for s.inflight < s.capacity {
+		var next *tenantQueue
+		for _, q := range s.tenants {
+			if q.waiters.Len() > 0 && s.eligible(q) && (next == nil || q.vtime < next.vtime) {
+				next = q
+			}
+		}
+		if next == nil {
+			return
+		}
+
+		w := next.waiters.Remove(next.waiters.Front()).(*waiter)
+		w.granted = true
+		close(w.ready)
+
+		s.queued--
+		s.inflight++
+		next.inflight++
+		s.vtime = next.vtime
+		next.vtime += 1 / s.weight(next.name)
+	}
+}
+
+func (s *scheduler) eligible(q *tenantQueue) bool {
+	maxInflight := s.limits(q.name).MaxInflight
+	return maxInflight <= 0 || q.inflight < maxInflight
+}
+
+func (s *scheduler) weight(tenant string) float64 {
+	if weight := s.limits(tenant).Weight; weight > 0 {
+		return weight
+	}
+	return 1
+}
+
+func (s *scheduler) queue(tenant string) *tenantQueue {
+	q, ok := s.tenants[tenant]
+	if !ok {
+		q = &tenantQueue{name: tenant, waiters: list.New(), vtime: s.vtime}
+		s.tenants[tenant] = q
+	}
+	return q
+}
+
+// cleanup 删除空闲租户的队列
+func (s *scheduler) cleanup(q *tenantQueue) {
+	if q.inflight == 0 && q.waiters.Len() == 0 {
+		delete(s.tenants, q.name)
+	}
+}
+
+// report 更新并发槽位和排队数的指标，调用时需持有 s.mu
+func (s *scheduler) report() {
+	inflightRequests.Set(float64(s.inflight))
+	queuedRequests.Set(float64(s.queued))
+}
+
+// retryAfter 返回建议客户端重试前等待的秒数
+func (s *scheduler) retryAfter() int {
+	return max(1, int(math.Ceil(s.maxQueueWait.Seconds())))
+}
+
+// stats 返回正在执行和排队中的请求数
+func (s *scheduler) stats() (inflight, queued int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.inflight, s.queued
+}
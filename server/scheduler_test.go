@@ -0,0 +1,203 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zhengtianbao/promproxy/config"
+)
+
+func testScheduler(capacity, maxQueueLength int, maxQueueWait time.Duration, limits map[string]config.LimitsConfig) *scheduler {
+	cfg := config.ServerConfig{MaxConcurrency: capacity, MaxQueueLength: maxQueueLength, MaxQueueWait: maxQueueWait}
+	return newScheduler(cfg, func(tenant string) config.LimitsConfig { return limits[tenant] })
+}
+
+// waitQueued 等待排队中的请求数达到 n
+func waitQueued(t *testing.T, s *scheduler, n int) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		if _, queued := s.stats(); queued == n {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d queued requests", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSchedulerWeightedFairness(t *testing.T) {
+	s := testScheduler(1, 0, 0, map[string]config.LimitsConfig{"a": {Weight: 1}, "b": {Weight: 2}})
+	if !s.tryAcquire("hold") {
+		t.Fatal("tryAcquire failed on an idle scheduler")
+	}
+
+	// 只有一个槽位，每次释放后恰好分配给一个排队的请求
+	granted := make(chan string)
+	for _, tenant := range []string{"a", "b"} {
+		for range 6 {
+			go func() {
+				if err := s.acquire(context.Background(), tenant); err != nil {
+					t.Error(err)
+					return
+				}
+				granted <- tenant
+			}()
+		}
+	}
+	waitQueued(t, s, 12)
+
+	s.release("hold")
+	counts := make(map[string]int)
+	for range 6 {
+		tenant := <-granted
+		counts[tenant]++
+		s.release(tenant)
+	}
+	if counts["a"] != 2 || counts["b"] != 4 {
+		t.Errorf("got %v in the first 6 grants, want a:2 b:4", counts)
+	}
+
+	for range 6 {
+		s.release(<-granted)
+	}
+	if inflight, queued := s.stats(); inflight != 0 || queued != 0 {
+		t.Errorf("got inflight %d, queued %d after all requests finished", inflight, queued)
+	}
+}
+
+func TestSchedulerMaxInflight(t *testing.T) {
+	s := testScheduler(4, 0, 0, map[string]config.LimitsConfig{"a": {MaxInflight: 1}})
+	ctx := context.Background()
+
+	if err := s.acquire(ctx, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if s.tryAcquire("a") {
+		t.Fatal("tryAcquire exceeded max_inflight")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.acquire(ctx, "a") }()
+	waitQueued(t, s, 1)
+
+	// 其他租户不受 a 的限制影响
+	if err := s.acquire(ctx, "b"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("second request of a granted while the first is running: %v", err)
+	default:
+	}
+
+	s.release("a")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	s.release("a")
+	s.release("b")
+	if inflight, queued := s.stats(); inflight != 0 || queued != 0 {
+		t.Errorf("got inflight %d, queued %d after all requests finished", inflight, queued)
+	}
+}
+
+func TestSchedulerQueueFull(t *testing.T) {
+	s := testScheduler(1, 1, 0, nil)
+	if !s.tryAcquire("a") {
+		t.Fatal("tryAcquire failed on an idle scheduler")
+	}
+
+	done := make(chan error, 1)
+	go func() { done <- s.acquire(context.Background(), "a") }()
+	waitQueued(t, s, 1)
+
+	if err := s.acquire(context.Background(), "a"); !errors.Is(err, errQueueFull) {
+		t.Fatalf("got %v, want %v", err, errQueueFull)
+	}
+
+	// 队列长度按租户计算
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.acquire(ctx, "b"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("got %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	s.release("a")
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	s.release("a")
+}
+
+func TestSchedulerQueueTimeout(t *testing.T) {
+	s := testScheduler(1, 0, 10*time.Millisecond, nil)
+	if !s.tryAcquire("a") {
+		t.Fatal("tryAcquire failed on an idle scheduler")
+	}
+
+	if err := s.acquire(context.Background(), "b"); !errors.Is(err, errQueueTimeout) {
+		t.Fatalf("got %v, want %v", err, errQueueTimeout)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.acquire(ctx, "b"); !errors.Is(err, context.Canceled) {
+		t.Fatalf("got %v, want %v", err, context.Canceled)
+	}
+
+	if inflight, queued := s.stats(); inflight != 1 || queued != 0 {
+		t.Errorf("got inflight %d, queued %d, want 1 and 0", inflight, queued)
+	}
+	if _, ok := s.tenants["b"]; ok {
+		t.Error("queue of a tenant without requests was not removed")
+	}
+	s.release("a")
+}
+
+// TestSchedulerTimeoutRace 让排队超时与槽位分配同时发生，槽位不能泄漏，也不能超过并发上限
+func TestSchedulerTimeoutRace(t *testing.T) {
+	const capacity = 2
+	s := testScheduler(capacity, 0, time.Millisecond, nil)
+
+	var running, peak atomic.Int32
+	var wg sync.WaitGroup
+	for i := range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tenant := []string{"a", "b", "c"}[i%3]
+			if err := s.acquire(context.Background(), tenant); err != nil {
+				if !errors.Is(err, errQueueTimeout) {
+					t.Error(err)
+				}
+				return
+			}
+			n := running.Add(1)
+			for {
+				p := peak.Load()
+				if n <= p || peak.CompareAndSwap(p, n) {
+					break
+				}
+			}
+			time.Sleep(time.Millisecond)
+			running.Add(-1)
+			s.release(tenant)
+		}()
+	}
+	wg.Wait()
+
+	if p := peak.Load(); p > capacity {
+		t.Errorf("got %d concurrent requests, want at most %d", p, capacity)
+	}
+	if inflight, queued := s.stats(); inflight != 0 || queued != 0 {
+		t.Errorf("got inflight %d, queued %d after all requests finished", inflight, queued)
+	}
+	if len(s.tenants) != 0 {
+		t.Errorf("got %d tenant queues after all requests finished", len(s.tenants))
+	}
+}
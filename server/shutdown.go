@@ -0,0 +1,44 @@
+package server
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// handleReady 为就绪检查，退出过程中返回 503 让负载均衡不再转发新请求
+func (p *ProxyServer) handleReady(w http.ResponseWriter, r *http.Request) {
+	if p.draining.Load() {
+		http.Error(w, "shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// shutdown 先让就绪检查失败并等待 shutdown_delay，再停止接收新连接，
+// 在 drain_timeout 内等待执行中和排队中的请求完成，超时后强制关闭剩余连接
+func (p *ProxyServer) shutdown(srv *http.Server) error {
+	p.draining.Store(true)
+	inflight, queued := p.scheduler.stats()
+	slog.Info("Shutting down", "inflight", inflight, "queued", queued)
+
+	if delay := p.config.Server.ShutdownDelay; delay > 0 {
+		slog.Info("Waiting before closing the listener", "delay", delay.String())
+		time.Sleep(delay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), p.config.Server.DrainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		inflight, queued := p.scheduler.stats()
+		slog.Warn("Drain timeout exceeded, closing connections",
+			"drain_timeout", p.config.Server.DrainTimeout.String(), "inflight", inflight, "queued", queued)
+		srv.Close()
+		return err
+	}
+
+	slog.Info("Shutdown complete")
+	return nil
+}
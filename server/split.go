@@ -0,0 +1,112 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/zhengtianbao/promproxy/config"
+)
+
+// splitRanges 按 interval 边界把 [start, end] 拆分为子区间，每个子区间的起止点都落在 start + k*step 上
+func splitRanges(start, end, step, interval int64) [][2]int64 {
+	var ranges [][2]int64
+	for cursor := start; cursor <= end; {
+		boundary := (cursor/interval + 1) * interval
+		last := min(end, alignDown(boundary-1, start, step))
+		if last < cursor {
+			last = cursor
+		}
+		ranges = append(ranges, [2]int64{cursor, last})
+		cursor = last + step
+	}
+	return ranges
+}
+
+// executeRange 执行 [start, end] 的范围查询，区间超过拆分间隔时拆分为子查询并行执行后拼接结果
+func (p *ProxyServer) executeRange(r *http.Request, pools []*backendPool, rp *rangeParams, start, end int64, limits config.LimitsConfig) (*apiResponse, []string, error) {
+	splitting := p.config.Splitting
+	if !splitting.Enabled || end-start < splitting.Interval.Milliseconds() {
+		return p.executeQuery(r.Context(), pools, r.URL.Path, rp.withRange(start, end), r.Header, limits)
+	}
+
+	ranges := splitRanges(start, end, rp.step, splitting.Interval.Milliseconds())
+	results := make([]fanoutResult, len(ranges))
+	backends := make([][]string, len(ranges))
+
+	jobs := make(chan int, len(ranges))
+	for i := range ranges {
+		jobs <- i
+	}
+	close(jobs)
+
+	worker := func() {
+		for i := range jobs {
+			results[i].resp, backends[i], results[i].err = p.executeQuery(r.Context(), pools, r.URL.Path,
+				rp.withRange(ranges[i][0], ranges[i][1]), r.Header, limits)
+		}
+	}
+
+	// 当前请求已占用一个并发槽位；额外的 worker 只在有空闲槽位时启动，避免相互等待
+	tenant := p.tenant(r)
+	var wg sync.WaitGroup
+	for n := 1; n < min(splitting.MaxParallelism, len(ranges)) && p.scheduler.tryAcquire(tenant); n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer p.scheduler.release(tenant)
+			worker()
+		}()
+	}
+	worker()
+	wg.Wait()
+
+	var used, warnings, infos []string
+	datas := make([]*queryData, 0, len(ranges))
+	for i, result := range results {
+		used = append(used, backends[i]...)
+		if result.err != nil {
+			return nil, uniqueStrings(used), result.err
+		}
+		datas = append(datas, result.resp.Data)
+		warnings = uniqueStrings(warnings, result.resp.Warnings)
+		infos = uniqueStrings(infos, result.resp.Infos)
+	}
+
+	data, err := mergeQueryData(datas)
+	if err != nil {
+		return nil, uniqueStrings(used), err
+	}
+
+	return &apiResponse{
+		Status:   "success",
+		Data:     data,
+		Warnings: warnings,
+		Infos:    infos,
+	}, uniqueStrings(used), nil
+}
+
+// serveSplitRange 拆分执行未命中缓存的范围查询；查询不需要或不能拆分时返回 false
+func (p *ProxyServer) serveSplitRange(w http.ResponseWriter, r *http.Request, pools []*backendPool, limits config.LimitsConfig) bool {
+	params, err := readForm(r)
+	if err != nil {
+		return false
+	}
+	rp, ok := p.parseRangeParams(params)
+	if !ok || rp.end-rp.start < p.config.Splitting.Interval.Milliseconds() {
+		return false
+	}
+
+	resp, backends, err := p.executeRange(r, pools, rp, rp.start, rp.end, limits)
+	w.Header().Set(backendHeader, strings.Join(backends, ","))
+	if err == nil {
+		err = checkMergedLimits(resp.Data, limits)
+	}
+	if err != nil {
+		writeBackendError(w, err)
+		return true
+	}
+
+	writeAPIResponse(w, resp)
+	return true
+}
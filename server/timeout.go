@@ -0,0 +1,101 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/zhengtianbao/promproxy/config"
+)
+
+const (
+	// 未指定 timeout 时客户端等待后端的最长时间
+	defaultBackendTimeout = 30 * time.Second
+	// 客户端截止时间比转发给后端的 timeout 略长，让后端先返回超时错误
+	backendTimeoutGrace = 5 * time.Second
+)
+
+// endpointTimeout 返回租户在该接口上允许的最长求值时间，0 表示使用 defaultBackendTimeout
+func endpointTimeout(path string, limits config.LimitsConfig) time.Duration {
+	switch {
+	case strings.HasSuffix(path, "/api/v1/query_range"):
+		return limits.RangeQueryTimeout
+	case strings.HasSuffix(path, "/api/v1/query"):
+		return limits.QueryTimeout
+	}
+	return 0
+}
+
+// clampTimeout 设置或收紧转发请求中的 timeout 参数，返回最终生效的超时；
+// 没有限制时客户端的 timeout 也不能超过 defaultBackendTimeout
+func clampTimeout(req *http.Request, limit time.Duration) (time.Duration, error) {
+	params := req.URL.Query()
+	requested := params.Get("timeout")
+
+	// POST 表单中的参数优先于 URL 参数
+	var form url.Values
+	if req.Method == http.MethodPost && req.Body != nil &&
+		strings.HasPrefix(req.Header.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		data, err := io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return 0, err
+		}
+		form, err = url.ParseQuery(string(data))
+		if err != nil {
+			return 0, err
+		}
+		if v := form.Get("timeout"); v != "" {
+			requested = v
+		}
+	}
+
+	var timeout time.Duration
+	if requested != "" {
+		d, err := parseDurationParam(requested)
+		if err != nil {
+			return 0, err
+		}
+		timeout = d
+	}
+	switch {
+	case limit > 0 && (timeout <= 0 || timeout > limit):
+		timeout = limit
+	case limit <= 0 && timeout > defaultBackendTimeout:
+		// 租户没有配置超时时，客户端的 timeout 不能超过默认的等待时间
+		timeout = defaultBackendTimeout
+	}
+
+	if timeout > 0 {
+		value := strconv.FormatFloat(timeout.Seconds(), 'f', -1, 64)
+		params.Set("timeout", value)
+		req.URL.RawQuery = params.Encode()
+		if form != nil {
+			form.Set("timeout", value)
+		}
+	}
+
+	if form != nil {
+		body := form.Encode()
+		req.Body = io.NopCloser(strings.NewReader(body))
+		req.ContentLength = int64(len(body))
+	}
+
+	return timeout, nil
+}
+
+// parseDurationParam 按 Prometheus 的规则解析浮点秒数或 duration 字符串
+func parseDurationParam(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := model.ParseDuration(s)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(d), nil
+}